@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// client is a principal allowed to use the server. If the configuration
+// lists no clients, the server is open to everyone.
+type client struct {
+	Name string `json:"name"`
+	// Auth is the basic auth login or bearer token the client presents.
+	// A client without auth is used for requests that carry no
+	// credentials.
+	Auth *credentials `json:"auth,omitempty"`
+	// Clones are glob patterns for the clone names, like "_two", the client
+	// may fetch. The empty name stands for unprefixed clones. If Clones is
+	// empty, every clone name is allowed.
+	Clones []string `json:"clones,omitempty"`
+	// Modules is a comma-separated list of module path glob patterns,
+	// matched like GOPRIVATE, that the client may clone. If empty, every
+	// module is allowed.
+	Modules string `json:"modules,omitempty"`
+}
+
+func (c *client) check() error {
+	if c.Name == "" {
+		return errors.New("missing name")
+	}
+	if c.Auth != nil {
+		if err := c.Auth.check(); err != nil {
+			return err
+		}
+		if c.Auth.Netrc != "" || c.Auth.Helper != "" {
+			return errors.New("client auth must be a username or a token")
+		}
+	}
+	for _, pat := range c.Clones {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("bad clone pattern %q", pat)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the request credentials identify c.
+func (c *client) matches(r *http.Request) (bool, error) {
+	user, pw, isBasic := r.BasicAuth()
+	token, isBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	switch {
+	case c.Auth == nil:
+		return r.Header.Get("Authorization") == "", nil
+	case c.Auth.Username != "":
+		if !isBasic || user != c.Auth.Username {
+			return false, nil
+		}
+		want, err := secret(c.Auth.Password, c.Auth.PasswordEnv)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(pw), []byte(want)) == 1, nil
+	default:
+		if !isBearer {
+			return false, nil
+		}
+		want, err := secret(c.Auth.Token, c.Auth.TokenEnv)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1, nil
+	}
+}
+
+// allows reports whether c may fetch module p under the given clone name.
+func (c *client) allows(clone, p string) bool {
+	if len(c.Clones) > 0 {
+		ok := false
+		for _, pat := range c.Clones {
+			if m, _ := path.Match(pat, clone); m {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return c.Modules == "" || module.MatchPrefixPatterns(c.Modules, p)
+}
+
+// authenticate returns the client making r, or nil if the server is open.
+func authenticate(r *http.Request) (*client, error) {
+	if len(conf.Clients) == 0 {
+		return nil, nil
+	}
+	for i := range conf.Clients {
+		c := &conf.Clients[i]
+		ok, err := c.matches(r)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return c, nil
+		}
+	}
+	return nil, &statusError{http.StatusUnauthorized, errors.New("authentication required")}
+}
+
+// authorize checks that the client making r may fetch the clone at
+// userPath, a path like "_two/golang.org/x/text" below the host.
+func authorize(r *http.Request, userPath string) error {
+	c, err := authenticate(r)
+	if err != nil || c == nil {
+		return err
+	}
+	clone, p := splitClonePath(userPath)
+	// Proxy and report paths are escaped, like "github.com/!foo", while
+	// vanity paths aren't, and patterns are matched against the real path.
+	if u, err := unescapeModPath(p); err == nil {
+		p = u
+	}
+	if !c.allows(clone, p) {
+		return &statusError{http.StatusForbidden, fmt.Errorf("%s may not fetch %s", c.Name, userPath)}
+	}
+	return nil
+}
+
+// splitClonePath splits a path like "_two/golang.org/x/text" into its clone
+// name and upstream path. Unprefixed clones have an empty clone name.
+func splitClonePath(userPath string) (clone, upstreamPath string) {
+	if strings.HasPrefix(userPath, "_") {
+		if segs := strings.SplitN(userPath, "/", 2); len(segs) == 2 {
+			return segs[0], segs[1]
+		}
+	}
+	return "", userPath
+}
+
+// writeError reports err to the client.
+func writeError(w http.ResponseWriter, err error) {
+	code := errorStatus(err)
+	if code == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="goclone"`)
+	}
+	http.Error(w, err.Error(), code)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	useUpstream(t, "off")
+	conf = &config{Clients: []client{
+		{Name: "ci", Auth: &credentials{Username: "ci", Password: "pw"}},
+		{Name: "bot", Auth: &credentials{Token: "tok"}, Clones: []string{"_two", "_v*"}, Modules: "golang.org/x/*"},
+		{Name: "anonymous", Clones: []string{""}, Modules: "example.org/public"},
+	}}
+	if err := conf.check(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		auth func(r *http.Request)
+		want int
+	}{
+		{"/_two/golang.org/x/text?go-get=1", func(r *http.Request) { r.SetBasicAuth("ci", "pw") }, http.StatusOK},
+		{"/_two/golang.org/x/text?go-get=1", func(r *http.Request) { r.SetBasicAuth("ci", "wrong") }, http.StatusUnauthorized},
+		{"/_two/golang.org/x/text?go-get=1", func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok") }, http.StatusOK},
+		{"/_v1/golang.org/x/text/encoding?go-get=1", func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok") }, http.StatusOK},
+		{"/_three/golang.org/x/text?go-get=1", func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok") }, http.StatusForbidden},
+		{"/_two/example.org/other?go-get=1", func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok") }, http.StatusForbidden},
+		{"/example.org/public/pkg?go-get=1", func(r *http.Request) {}, http.StatusOK},
+		{"/_two/example.org/public?go-get=1", func(r *http.Request) {}, http.StatusForbidden},
+		{"/golang.org/x/text?go-get=1", func(r *http.Request) { r.Header.Set("Authorization", "Bearer nope") }, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		tt.auth(req)
+		w := httptest.NewRecorder()
+		vanityHandler(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s: got %d, want %d: %s", tt.path, w.Code, tt.want, w.Body)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: missing WWW-Authenticate", tt.path)
+		}
+	}
+}
+
+func TestProxyHandlerRequiresAuth(t *testing.T) {
+	serveUpstream(t, newUpstreamHandler(t))
+	conf = &config{Clients: []client{{Name: "ci", Auth: &credentials{Token: "tok"}}}}
+
+	req := httptest.NewRequest("GET", "/_mod/goclone.example.com/example.com/mod/@v/list", nil)
+	w := httptest.NewRecorder()
+	proxyHandler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+	req.Header.Set("Authorization", "Bearer tok")
+	w = httptest.NewRecorder()
+	proxyHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestAuthorizeEscapedPath(t *testing.T) {
+	useUpstream(t, "off")
+	conf = &config{Clients: []client{{Name: "ci", Auth: &credentials{Token: "tok"}, Modules: "github.com/BurntSushi/*"}}}
+	for _, userPath := range []string{"_two/github.com/!burnt!sushi/toml", "_two/github.com/BurntSushi/toml"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer tok")
+		if err := authorize(req, userPath); err != nil {
+			t.Errorf("%s: %v", userPath, err)
+		}
+	}
+}
+
+func TestClientCheck(t *testing.T) {
+	for _, c := range []client{
+		{},
+		{Name: "x", Auth: &credentials{Netrc: "/etc/netrc"}},
+		{Name: "x", Clones: []string{"["}},
+	} {
+		if err := c.check(); err == nil {
+			t.Errorf("expected error for %+v", c)
+		}
+	}
+}
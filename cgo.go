@@ -0,0 +1,634 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// C symbols are global to a binary, so two clones of a module using cgo
+// fail to link if the module defines C functions or variables with
+// external linkage, or exports Go functions to C with //export. In cgo
+// prefix mode, goclone renames those symbols with a prefix for the clone:
+// C definitions and references are renamed token by token in the module's C
+// sources and cgo preambles, along with C.name references in Go, and
+// exported Go functions keep their Go names but get a #define in their
+// preamble, which cgo copies into _cgo_export.h, to rename the C function
+// it generates. The scan is lexical, not a C parser, so it only finds
+// definitions written in the usual way. What it can't rename, like
+// assembly and prebuilt objects, is reported as a problem.
+
+// cgoSymbol is a C symbol a module defines.
+type cgoSymbol struct {
+	Name string `json:"name"`
+	// Kind is "export" for Go functions exported with //export, and
+	// "function" or "variable" for C definitions.
+	Kind string `json:"kind"`
+	File string `json:"file"`
+	Line int    `json:"line"`
+}
+
+// cgoReport lists the C symbols a module defines, and the reasons it can't
+// be cloned safely in cgo prefix mode, if any.
+type cgoReport struct {
+	Module   string      `json:"module"`
+	Version  string      `json:"version"`
+	Symbols  []cgoSymbol `json:"symbols"`
+	Problems []string    `json:"problems"`
+}
+
+var cgoReports = &byteCache{max: 256}
+
+// cgoReportFor returns the report for upstreamPath at the escaped version
+// ev, patched with patches. zipData is the patched module zip if the caller
+// already has it.
+func cgoReportFor(upstreamPath, ev string, patches *patchSet, zipData []byte) (*cgoReport, error) {
+	rep := &cgoReport{}
+	err := buildReport(cgoReports, upstreamPath, ev, patches, zipData, rep, func(modPath, v string, zipData, modData []byte) (err error) {
+		rep.Module, rep.Version = modPath, v
+		rep.Symbols, rep.Problems, err = scanCgo(zipData)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// cExts are the extensions of the C, C++ and Objective-C sources cgo
+// compiles, and their headers.
+var cExts = map[string]bool{
+	".c": true, ".h": true, ".cc": true, ".cpp": true, ".cxx": true,
+	".hh": true, ".hpp": true, ".hxx": true, ".m": true, ".mm": true,
+}
+
+// scanCgo returns the C symbols defined by the packages in zipData that
+// can be linked into other binaries, and the problems in renaming them.
+func scanCgo(zipData []byte) ([]cgoSymbol, []string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, nil, &statusError{http.StatusBadGateway, err}
+	}
+	cgoDirs := map[string]bool{}
+	var syms []cgoSymbol
+	var problems []string
+	var cFiles, asmFiles []*zip.File
+	for _, f := range zr.File {
+		rel, ok := zipRelPath(f.Name)
+		if !ok || !linkableDir(path.Dir(rel)) {
+			continue
+		}
+		switch ext := path.Ext(rel); {
+		case ext == ".go" && !strings.HasSuffix(rel, "_test.go"):
+			src, err := readZipFile(f)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !bytes.Contains(src, []byte(`"C"`)) {
+				continue
+			}
+			fset := token.NewFileSet()
+			af, err := parser.ParseFile(fset, rel, src, parser.ParseComments)
+			if err != nil || af.Name.Name == "main" || ignoredFile(af) {
+				continue
+			}
+			if !importsC(af) {
+				continue
+			}
+			_, doc := cImport(af)
+			cgoDirs[path.Dir(rel)] = true
+			for _, name := range cgoExports(af) {
+				syms = append(syms, cgoSymbol{Name: name.Name, Kind: "export", File: rel, Line: fset.Position(name.Pos()).Line})
+			}
+			if doc == nil {
+				continue
+			}
+			// Lay out the preamble on the lines it has in the file, so
+			// that the symbols get the right line numbers.
+			var preamble []byte
+			for _, c := range doc.List {
+				line := fset.Position(c.Pos()).Line
+				for n := bytes.Count(preamble, []byte("\n")); n < line-1; n++ {
+					preamble = append(preamble, '\n')
+				}
+				preamble = append(preamble, commentContent(c.Text)...)
+				preamble = append(preamble, '\n')
+			}
+			for _, d := range cDefinitions(preamble) {
+				syms = append(syms, cgoSymbol{Name: d.text, Kind: d.kind, File: rel, Line: d.line})
+			}
+			for _, line := range strings.Split(doc.Text(), "\n") {
+				if strings.HasPrefix(line, "#cgo ") && strings.Contains(line, "LDFLAGS") && strings.Contains(line, "${SRCDIR}") {
+					problems = append(problems, fmt.Sprintf("%s: links a library from the module, whose symbols can't be renamed", rel))
+				}
+			}
+		case ext == ".syso":
+			problems = append(problems, fmt.Sprintf("%s: prebuilt object, whose symbols can't be renamed", rel))
+		case ext == ".s" || ext == ".S" || ext == ".sx":
+			asmFiles = append(asmFiles, f)
+		case cExts[ext] && ext != ".h" && ext != ".hh" && ext != ".hpp" && ext != ".hxx":
+			cFiles = append(cFiles, f)
+		}
+	}
+	for _, f := range asmFiles {
+		// Assembly in cgo packages goes to the C compiler and may define
+		// C symbols; in other packages it is Go assembly, which is safe.
+		if rel, _ := zipRelPath(f.Name); cgoDirs[path.Dir(rel)] {
+			problems = append(problems, fmt.Sprintf("%s: assembly in a cgo package, whose symbols can't be renamed", rel))
+		}
+	}
+	for _, f := range cFiles {
+		rel, _ := zipRelPath(f.Name)
+		if !cgoDirs[path.Dir(rel)] {
+			continue
+		}
+		src, err := readZipFile(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, d := range cDefinitions(src) {
+			syms = append(syms, cgoSymbol{Name: d.text, Kind: d.kind, File: rel, Line: d.line})
+		}
+	}
+	sort.Slice(syms, func(i, j int) bool {
+		if syms[i].File != syms[j].File {
+			return syms[i].File < syms[j].File
+		}
+		return syms[i].Line < syms[j].Line
+	})
+	sort.Strings(problems)
+	return syms, problems, nil
+}
+
+// importsC reports whether f imports "C".
+func importsC(f *ast.File) bool {
+	for _, imp := range f.Imports {
+		if imp.Path.Value == `"C"` {
+			return true
+		}
+	}
+	return false
+}
+
+// cImport returns the position to insert preamble lines before, just
+// before the import of "C" in f, and the preamble, if any.
+func cImport(f *ast.File) (token.Pos, *ast.CommentGroup) {
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.IMPORT {
+			continue
+		}
+		for _, spec := range gd.Specs {
+			is := spec.(*ast.ImportSpec)
+			if is.Path.Value != `"C"` {
+				continue
+			}
+			if is.Doc != nil || gd.Lparen.IsValid() {
+				return is.Pos(), is.Doc
+			}
+			return gd.Pos(), gd.Doc
+		}
+	}
+	return token.NoPos, nil
+}
+
+// cgoExports returns the names of the functions in f exported with
+// //export.
+func cgoExports(f *ast.File) []*ast.Ident {
+	var names []*ast.Ident
+	for _, decl := range f.Decls {
+		fd, ok := decl.(*ast.FuncDecl)
+		if !ok || fd.Doc == nil || fd.Recv != nil {
+			continue
+		}
+		for _, c := range fd.Doc.List {
+			if name, ok := strings.CutPrefix(c.Text, "//export "); ok && strings.TrimSpace(name) == fd.Name.Name {
+				names = append(names, fd.Name)
+			}
+		}
+	}
+	return names
+}
+
+// commentContent returns the text of a Go comment without its markers.
+func commentContent(text string) string {
+	if content, ok := strings.CutPrefix(text, "//"); ok {
+		return content
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(text, "/*"), "*/")
+}
+
+// cToken is an identifier or punctuation byte in C source.
+type cToken struct {
+	text string
+	pos  int
+	line int
+	// directive is set for tokens in preprocessor directives.
+	directive bool
+	// kind is set by cDefinitions.
+	kind string
+}
+
+// opaqueDirectives are the preprocessor directives whose tokens lexC
+// leaves out, because they aren't C code: renaming a symbol in them would
+// change a header name or a build flag.
+var opaqueDirectives = map[string]bool{
+	"include": true, "include_next": true, "import": true, "cgo": true,
+	"pragma": true, "line": true, "error": true, "warning": true,
+}
+
+// lexC returns the identifiers and punctuation in C source, skipping
+// comments, literals and numbers.
+func lexC(src []byte) []cToken {
+	var toks []cToken
+	line := 1
+	lineStart, inDirective, opaque := true, false, false
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			if inDirective && (i == 0 || src[i-1] != '\\') {
+				inDirective, opaque = false, false
+			}
+			line++
+			lineStart = true
+			i++
+			continue
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v' || c == '\\':
+			i++
+			continue
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := len(src)
+			if j := bytes.Index(src[i+2:], []byte("*/")); j >= 0 {
+				end = i + 2 + j + 2
+			}
+			line += bytes.Count(src[i:end], []byte("\n"))
+			i = end
+			continue
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != c && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			i = min(j+1, len(src))
+		case c == '#' && lineStart:
+			inDirective = true
+			j := i + 1
+			for j < len(src) && (src[j] == ' ' || src[j] == '\t') {
+				j++
+			}
+			k := j
+			for k < len(src) && isCIdent(src[k]) {
+				k++
+			}
+			opaque = opaqueDirectives[string(src[j:k])]
+			i = k
+		case isCIdent(c) && (c < '0' || c > '9'):
+			j := i
+			for j < len(src) && isCIdent(src[j]) {
+				j++
+			}
+			if !opaque {
+				toks = append(toks, cToken{text: string(src[i:j]), pos: i, line: line, directive: inDirective})
+			}
+			i = j
+		case c >= '0' && c <= '9':
+			for i < len(src) && (isCIdent(src[i]) || src[i] == '.') {
+				i++
+			}
+		default:
+			if !opaque {
+				toks = append(toks, cToken{text: string(c), pos: i, line: line, directive: inDirective})
+			}
+			i++
+		}
+		lineStart = false
+	}
+	return toks
+}
+
+func isCIdent(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// cKeywords are the C keywords that can come before a declared name.
+var cKeywords = map[string]bool{
+	"auto": true, "bool": true, "_Bool": true, "char": true, "const": true,
+	"double": true, "enum": true, "extern": true, "float": true,
+	"inline": true, "int": true, "long": true, "register": true,
+	"restrict": true, "short": true, "signed": true, "static": true,
+	"struct": true, "typedef": true, "union": true, "unsigned": true,
+	"void": true, "volatile": true, "_Thread_local": true,
+	"thread_local": true, "__thread": true, "class": true,
+}
+
+// cDefinitions returns the names of the functions and variables with
+// external linkage that C source defines at file scope, with kind set to
+// "function" or "variable".
+func cDefinitions(src []byte) []cToken {
+	var defs []cToken
+	var decl []cToken
+	depth, open := 0, 0
+	for _, t := range lexC(src) {
+		if t.directive {
+			continue
+		}
+		if depth > 0 {
+			switch t.text {
+			case "{":
+				depth++
+			case "}":
+				depth--
+			}
+			continue
+		}
+		switch t.text {
+		case "{":
+			switch {
+			case len(decl) == 1 && decl[0].text == "extern", len(decl) > 0 && decl[0].text == "namespace":
+				// The contents of extern "C" and namespace blocks are
+				// at file scope.
+				open++
+				decl = nil
+			case !hasCToken(decl, "=") && len(decl) > 0 && decl[len(decl)-1].text == ")":
+				if name, ok := cFuncName(decl); ok && !hasCToken(decl, "static") {
+					name.kind = "function"
+					defs = append(defs, name)
+				}
+				depth = 1
+				decl = nil
+			default:
+				// An initializer or a struct body, after which the
+				// declaration goes on.
+				depth = 1
+				decl = append(decl, cToken{text: "{}"})
+			}
+		case "}":
+			if open > 0 {
+				open--
+			}
+			decl = nil
+		case ";":
+			for _, name := range cVarNames(decl) {
+				name.kind = "variable"
+				defs = append(defs, name)
+			}
+			decl = nil
+		default:
+			decl = append(decl, t)
+		}
+	}
+	return defs
+}
+
+func hasCToken(toks []cToken, text string) bool {
+	for _, t := range toks {
+		if t.text == text {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutAttributes returns decl without GCC attributes.
+func withoutAttributes(decl []cToken) []cToken {
+	var out []cToken
+	for i := 0; i < len(decl); i++ {
+		if decl[i].text != "__attribute__" && decl[i].text != "__declspec" {
+			out = append(out, decl[i])
+			continue
+		}
+		depth := 0
+		for i+1 < len(decl) {
+			i++
+			if decl[i].text == "(" {
+				depth++
+			} else if decl[i].text == ")" {
+				if depth--; depth == 0 {
+					break
+				}
+			}
+		}
+	}
+	return out
+}
+
+// cFuncName returns the name of the function a definition's declaration
+// part declares: the identifier before the first parenthesis.
+func cFuncName(decl []cToken) (cToken, bool) {
+	decl = withoutAttributes(decl)
+	for i, t := range decl {
+		if t.text != "(" {
+			continue
+		}
+		if i == 0 || cKeywords[decl[i-1].text] || !isCIdent(decl[i-1].text[0]) || i >= 2 && decl[i-2].text == ":" {
+			return cToken{}, false
+		}
+		return decl[i-1], true
+	}
+	return cToken{}, false
+}
+
+// cVarNames returns the names of the variables with external linkage that
+// a file scope declaration, without its semicolon, defines.
+func cVarNames(decl []cToken) []cToken {
+	decl = withoutAttributes(decl)
+	for _, t := range decl {
+		if t.text == "=" {
+			break
+		}
+		switch t.text {
+		case "(", "typedef", "extern", "static", "using", "template", "namespace":
+			return nil
+		}
+	}
+	var names []cToken
+	var declarator []cToken
+	depth := 0
+	flush := func() {
+		var name cToken
+		for i, t := range declarator {
+			if t.text == "=" || t.text == "[" {
+				break
+			}
+			if isCIdent(t.text[0]) && !cKeywords[t.text] && (i == 0 || !isTagKeyword(declarator[i-1].text)) {
+				name = t
+			}
+		}
+		if name.text != "" && (len(names) > 0 || len(declarator) > 1) {
+			names = append(names, name)
+		}
+		declarator = nil
+	}
+	for _, t := range decl {
+		switch t.text {
+		case "(", "[":
+			depth++
+		case ")", "]":
+			depth--
+		case ",":
+			if depth == 0 {
+				flush()
+				continue
+			}
+		}
+		declarator = append(declarator, t)
+	}
+	flush()
+	return names
+}
+
+func isTagKeyword(s string) bool {
+	return s == "struct" || s == "union" || s == "enum" || s == "class"
+}
+
+// renameC renames the identifiers in C source according to rename, except
+// for member names after "." or "->".
+func renameC(src []byte, rename map[string]string) ([]byte, bool) {
+	var out []byte
+	last := 0
+	var prev, prev2 string
+	for _, t := range lexC(src) {
+		if newName, ok := rename[t.text]; ok && prev != "." && !(prev == ">" && prev2 == "-") {
+			out = append(out, src[last:t.pos]...)
+			out = append(out, newName...)
+			last = t.pos + len(t.text)
+		}
+		prev2, prev = prev, t.text
+	}
+	if out == nil {
+		return src, false
+	}
+	return append(out, src[last:]...), true
+}
+
+// cgoPrefix returns the prefix for C symbols in the clone.
+func cgoPrefix(clone string) string {
+	if clone == "" {
+		clone = *host
+	}
+	b := []byte("goclone_" + strings.TrimPrefix(clone, "_") + "_")
+	for i, c := range b {
+		if !isCIdent(c) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// cgoPrefixer is the transform that renames a module's C symbols.
+type cgoPrefixer struct {
+	rename  map[string]string
+	exports map[string]bool
+}
+
+func newCgoPrefixer(syms []cgoSymbol, prefix string) *cgoPrefixer {
+	x := &cgoPrefixer{rename: map[string]string{}, exports: map[string]bool{}}
+	for _, s := range syms {
+		x.rename[s.Name] = prefix + s.Name
+		if s.Kind == "export" {
+			x.exports[s.Name] = true
+		}
+	}
+	return x
+}
+
+func (x *cgoPrefixer) mayApply(src []byte) bool {
+	for name := range x.rename {
+		if bytes.Contains(src, []byte(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *cgoPrefixer) applySrc(name string, src []byte) ([]byte, error) {
+	ext := path.Ext(name)
+	if cExts[ext] {
+		out, _ := renameC(src, x.rename)
+		return out, nil
+	}
+	if ext != ".go" {
+		return src, nil
+	}
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, name, src, parser.ParseComments)
+	if err != nil || !importsC(f) {
+		return src, nil
+	}
+	type edit struct {
+		start, end int
+		text       string
+	}
+	var edits []edit
+	offset := func(p token.Pos) int { return fset.Position(p).Offset }
+	at, doc := cImport(f)
+	if doc != nil {
+		for _, c := range doc.List {
+			content := commentContent(c.Text)
+			if renamed, ok := renameC([]byte(content), x.rename); ok {
+				start := offset(c.Pos()) + 2
+				edits = append(edits, edit{start, start + len(content), string(renamed)})
+			}
+		}
+	}
+	ast.Inspect(f, func(n ast.Node) bool {
+		sel, ok := n.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		if id, ok := sel.X.(*ast.Ident); ok && id.Name == "C" && !x.exports[sel.Sel.Name] {
+			if newName, ok := x.rename[sel.Sel.Name]; ok {
+				edits = append(edits, edit{offset(sel.Sel.Pos()), offset(sel.Sel.End()), newName})
+			}
+		}
+		return true
+	})
+	var defines strings.Builder
+	for _, id := range cgoExports(f) {
+		if x.exports[id.Name] {
+			fmt.Fprintf(&defines, "// #define %s %s\n", id.Name, x.rename[id.Name])
+		}
+	}
+	if defines.Len() > 0 {
+		// The defines join the preamble, so they go right before the
+		// import, on lines of their own.
+		pos := offset(at)
+		lineStart := bytes.LastIndexByte(src[:pos], '\n') + 1
+		if indent := src[lineStart:pos]; len(bytes.TrimSpace(indent)) == 0 {
+			lines := strings.SplitAfter(strings.TrimSuffix(defines.String(), "\n"), "\n")
+			edits = append(edits, edit{lineStart, lineStart, string(indent) + strings.Join(lines, string(indent)) + "\n"})
+		} else {
+			edits = append(edits, edit{pos, pos, "\n" + defines.String()})
+		}
+	}
+	if len(edits) == 0 {
+		return src, nil
+	}
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	out := bytes.Clone(src)
+	for _, e := range edits {
+		out = append(out[:e.start], append([]byte(e.text), out[e.end:]...)...)
+	}
+	return out, nil
+}
+
+// cgoProblemError reports why a module can't be cloned in cgo prefix mode.
+func cgoProblemError(rep *cgoReport) error {
+	return &statusError{http.StatusUnprocessableEntity, fmt.Errorf("%s@%s can't be cloned with its C symbols renamed:\n\t%s", rep.Module, rep.Version, strings.Join(rep.Problems, "\n\t"))}
+}
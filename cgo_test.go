@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCDefinitions(t *testing.T) {
+	src := `#include <stdio.h>
+#define MAX(a, b) ((a) > (b) ? (a) : (b))
+
+// int commented(void) {}
+static int hidden(void) { return 0; }
+int visible(int a, char *b) {
+	struct { int x; } s = {1};
+	return s.x;
+}
+__attribute__((visibility("default"))) void attributed(void) {}
+int counter = 0, *ptr, table[4] = {1, 2};
+const char *name = "int fake(void) {}";
+static int private_var;
+extern int declared;
+int prototype(void);
+typedef struct point { int x, y; } point;
+struct point origin;
+struct tag;
+enum color { RED, GREEN };
+void (*callback)(void);
+extern "C" {
+int wrapped(void) { return 1; }
+}
+`
+	var got []string
+	for _, d := range cDefinitions([]byte(src)) {
+		got = append(got, fmt.Sprintf("%s %s:%d", d.kind, d.text, d.line))
+	}
+	want := []string{
+		"function visible:6",
+		"function attributed:10",
+		"variable counter:11",
+		"variable ptr:11",
+		"variable table:11",
+		"variable name:12",
+		"variable origin:17",
+		"function wrapped:22",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+}
+
+func TestRenameC(t *testing.T) {
+	src := "#include \"counter.h\"\nint counter; // counter\nint f(void) { return counter + s.counter + p->counter + counter_max; }\nconst char *s = \"counter\";\n"
+	got, changed := renameC([]byte(src), map[string]string{"counter": "goclone_two_counter"})
+	want := "#include \"counter.h\"\nint goclone_two_counter; // counter\nint f(void) { return goclone_two_counter + s.counter + p->counter + counter_max; }\nconst char *s = \"counter\";\n"
+	if !changed || string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCgoPrefix(t *testing.T) {
+	useUpstream(t, "off")
+	for clone, want := range map[string]string{"_two": "goclone_two_", "_v1.2": "goclone_v1_2_", "": "goclone_goclone_example_com_"} {
+		if got := cgoPrefix(clone); got != want {
+			t.Errorf("cgoPrefix(%q) = %q, want %q", clone, got, want)
+		}
+	}
+}
+
+// cgoModuleFiles are the files of a cgo module that defines C symbols in a
+// preamble and a C file, and exports a Go function.
+var cgoModuleFiles = map[string]string{
+	"go.mod": "module example.com/cg\n\ngo 1.20\n",
+	"cg.go": `package cg
+
+/*
+int counter = 0;
+int bump(void);
+*/
+import "C"
+
+func Bump() int { return int(C.bump()) }
+`,
+	"export.go": `package cg
+
+import "C"
+
+//export goAdd
+func goAdd(a, b C.int) C.int { return a + b }
+`,
+	"cg.c": `#include "_cgo_export.h"
+
+extern int counter;
+
+static int one(void) { return 1; }
+
+int bump(void) {
+	counter++;
+	return goAdd(counter, one());
+}
+`,
+	"cg_test.go": "package cg\n",
+}
+
+func TestScanCgo(t *testing.T) {
+	syms, problems, err := scanCgo(buildZip(t, "example.com/cg@v1.0.0/", cgoModuleFiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []cgoSymbol{
+		{Name: "bump", Kind: "function", File: "cg.c", Line: 7},
+		{Name: "counter", Kind: "variable", File: "cg.go", Line: 4},
+		{Name: "goAdd", Kind: "export", File: "export.go", Line: 6},
+	}
+	if !reflect.DeepEqual(syms, want) || len(problems) != 0 {
+		t.Errorf("got %+v %q, want %+v", syms, problems, want)
+	}
+
+	files := map[string]string{
+		"go.mod":           "module example.com/cg\n",
+		"cg.go":            "package cg\n\n// #cgo LDFLAGS: -L${SRCDIR}/lib -lcg\nimport \"C\"\n",
+		"asm_amd64.S":      "",
+		"blob.syso":        "",
+		"pure/pure.go":     "package pure\n",
+		"pure/asm_amd64.s": "",
+	}
+	_, problems, err = scanCgo(buildZip(t, "example.com/cg@v1.0.0/", files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantProblems := []string{
+		"asm_amd64.S: assembly in a cgo package, whose symbols can't be renamed",
+		"blob.syso: prebuilt object, whose symbols can't be renamed",
+		"cg.go: links a library from the module, whose symbols can't be renamed",
+	}
+	if !reflect.DeepEqual(problems, wantProblems) {
+		t.Errorf("got problems %q, want %q", problems, wantProblems)
+	}
+}
+
+func TestCgoPrefixerGo(t *testing.T) {
+	x := newCgoPrefixer([]cgoSymbol{{Name: "bump", Kind: "function"}, {Name: "goAdd", Kind: "export"}}, "goclone_two_")
+	src := "package cg\n\n/*\nint bump(void);\n*/\nimport \"C\"\n\n//export goAdd\nfunc goAdd(a, b C.int) C.int { return C.bump() }\n"
+	got, err := x.applySrc("example.com/cg@v1.0.0/cg.go", []byte(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "package cg\n\n/*\nint goclone_two_bump(void);\n*/\n// #define goAdd goclone_two_goAdd\nimport \"C\"\n\n//export goAdd\nfunc goAdd(a, b C.int) C.int { return C.goclone_two_bump() }\n"
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	src = "package cg\n\nimport (\n\t\"fmt\"\n\t\"C\"\n)\n\n//export goAdd\nfunc goAdd() { fmt.Println() }\n"
+	got, _ = x.applySrc("example.com/cg@v1.0.0/cg.go", []byte(src))
+	want = "package cg\n\nimport (\n\t\"fmt\"\n\t// #define goAdd goclone_two_goAdd\n\t\"C\"\n)\n\n//export goAdd\nfunc goAdd() { fmt.Println() }\n"
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestProxyHandlerCgoProblems(t *testing.T) {
+	files := map[string]string{
+		"go.mod":    "module example.com/cgbad\n",
+		"cg.go":     "package cg\n\nimport \"C\"\n",
+		"blob.syso": "",
+	}
+	zipData := buildZip(t, "example.com/cgbad@v1.0.0/", files)
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".zip") {
+			w.Write(zipData)
+			return
+		}
+		w.Write([]byte(files["go.mod"]))
+	}))
+	conf = &config{Clones: []cloneDef{{Name: "_c", CgoPrefix: true}}}
+
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_c/example.com/cgbad/@v/v1.0.0.zip", nil))
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "blob.syso: prebuilt object") {
+		t.Errorf("got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCgoPrefixLink(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skip("no C compiler")
+	}
+	zipData := buildZip(t, "example.com/cg@v1.0.0/", cgoModuleFiles)
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example.com/cg/@v/list":
+			w.Write([]byte("v1.0.0\n"))
+		case "/example.com/cg/@v/v1.0.0.info":
+			w.Write([]byte(`{"Version":"v1.0.0","Time":"2023-01-01T00:00:00Z"}`))
+		case "/example.com/cg/@v/v1.0.0.mod":
+			w.Write([]byte(cgoModuleFiles["go.mod"]))
+		case "/example.com/cg/@v/v1.0.0.zip":
+			w.Write(zipData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	conf = &config{Clones: []cloneDef{{Name: "_a", CgoPrefix: true}, {Name: "_b", CgoPrefix: true}}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_mod/", proxyHandler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	clientDir := t.TempDir()
+	goMod := "module client\n\ngo 1.20\n\nrequire (\n\tgoclone.example.com/_a/example.com/cg v1.0.0\n\tgoclone.example.com/_b/example.com/cg v1.0.0\n)\n"
+	mainSrc := "package main\n\nimport (\n\ta \"goclone.example.com/_a/example.com/cg\"\n\tb \"goclone.example.com/_b/example.com/cg\"\n)\n\nfunc main() { println(a.Bump() + b.Bump()) }\n"
+	os.WriteFile(filepath.Join(clientDir, "go.mod"), []byte(goMod), 0o644)
+	os.WriteFile(filepath.Join(clientDir, "main.go"), []byte(mainSrc), 0o644)
+	cmd := exec.Command("go", "build", "-o", os.DevNull, ".")
+	cmd.Dir = clientDir
+	cmd.Env = append(os.Environ(),
+		"CGO_ENABLED=1",
+		"GOMODCACHE="+t.TempDir(),
+		"GOPROXY="+srv.URL+"/_mod",
+		"GOSUMDB=off",
+		"GOFLAGS=-buildvcs=false -modcacherw -mod=mod",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("go build failed: %v\n%s", err, out)
+	}
+}
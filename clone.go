@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// cloneDef configures the clones with a given name, like "_legacy". The
+// first definition whose name and modules match a clone applies to it.
+type cloneDef struct {
+	Name string `json:"name"`
+	// Modules is a comma-separated list of upstream module path glob
+	// patterns, matched like GOPRIVATE, that the definition applies to.
+	// Empty matches every module.
+	Modules string `json:"modules,omitempty"`
+	// Versions restricts the clone to the versions in a range like
+	// "<v0.4.0". Other versions are left out of lists and not served.
+	Versions *versionConstraint `json:"versions,omitempty"`
+	// Recursive is a comma-separated list of module path glob patterns,
+	// matched like GOPRIVATE, of dependencies to clone along with every
+	// module in the clone, as if their require lines had a
+	// "goclone:recursive" comment. The dependencies are themselves part of
+	// the clone and clone the same dependencies, but the rest of the
+	// definition, like Versions, applies only to the modules it names.
+	Recursive string `json:"recursive,omitempty"`
+	// Deep carries recursive cloning through the whole clone family: a
+	// module is cloned along with the dependencies that any of its
+	// recursively cloned dependencies clone, transitively, and not only
+	// with its own.
+	Deep bool `json:"deep,omitempty"`
+	// AutoRecursive also clones the dependencies whose types or state
+	// appear in the exported API of a module in the clone, as found by the
+	// analysis behind /_report/deps/.
+	AutoRecursive bool `json:"autoRecursive,omitempty"`
+	// WarnRegistrations scans the zips of modules in the clone for global
+	// registrations, as /_report/registrations/ lists them, and serves
+	// those that make any with an X-Goclone-Warning header.
+	WarnRegistrations bool `json:"warnRegistrations,omitempty"`
+	// Namespace renames the names modules in the clone register with
+	// database/sql, encoding/gob and expvar to end in "@" and the clone
+	// name, so that the clone can be linked alongside the original. The
+	// renamed names are listed at @v/<version>.goclone.json.
+	Namespace bool `json:"namespace,omitempty"`
+	// CgoPrefix renames the C symbols modules in the clone define or
+	// export, so that the clone can be linked alongside the original.
+	// Modules whose symbols can't all be renamed aren't served.
+	CgoPrefix bool `json:"cgoPrefix,omitempty"`
+	// RenamePackages appends the clone name to the names of the packages
+	// of modules in the clone, so that package text becomes text_two in
+	// clone _two and importers needn't name the imports of two copies.
+	RenamePackages bool `json:"renamePackages,omitempty"`
+	// Sources take the code of modules in the clone from other modules,
+	// such as forks, while imports are rewritten as for clones of the
+	// originals.
+	Sources []moduleSource `json:"sources,omitempty"`
+	// Patches are applied to the modules in the clone.
+	Patches []patchDef `json:"patches,omitempty"`
+	// Slim leaves classes of files out of the zips of modules in the
+	// clone: "tests", "testdata", "examples" and "docs". License files
+	// and files embedded by the remaining Go files are kept.
+	Slim []string `json:"slim,omitempty"`
+	// Notice adds a notice of what goclone changed to the zips of modules
+	// in the clone, as NOTICE.goclone, and a comment pointing to it at the
+	// top of each Go file changed.
+	Notice bool `json:"notice,omitempty"`
+}
+
+// moduleSource is where the code of a module in a clone comes from.
+type moduleSource struct {
+	// Module is the path of the module as cloned, which imports are
+	// rewritten from.
+	Module string `json:"module"`
+	// Source is the path of the module fetched from the upstream.
+	Source string `json:"source"`
+	// Version, if set, is the only version of the source served. Otherwise
+	// the clone has the versions of the source.
+	Version string `json:"version,omitempty"`
+}
+
+func (d *cloneDef) check() error {
+	if d.Name == "" {
+		return errors.New("missing name")
+	}
+	for i, s := range d.Sources {
+		if err := module.CheckPath(s.Module); err != nil {
+			return fmt.Errorf("sources[%d]: %v", i, err)
+		}
+		if err := module.CheckPath(s.Source); err != nil {
+			return fmt.Errorf("sources[%d]: %v", i, err)
+		}
+		if s.Version != "" {
+			if err := module.Check(s.Source, s.Version); err != nil {
+				return fmt.Errorf("sources[%d]: %v", i, err)
+			}
+			if semver.Canonical(s.Version) != s.Version {
+				return fmt.Errorf("sources[%d]: version %s is not canonical", i, s.Version)
+			}
+		}
+	}
+	if err := checkSlim(d.Slim); err != nil {
+		return err
+	}
+	for i := range d.Patches {
+		if err := d.Patches[i].check(); err != nil {
+			return fmt.Errorf("patches[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// source returns the configured source of module p, or nil.
+func (d *cloneDef) source(p string) *moduleSource {
+	if d == nil {
+		return nil
+	}
+	for i, s := range d.Sources {
+		if s.Module == p {
+			return &d.Sources[i]
+		}
+	}
+	return nil
+}
+
+// fetchPath returns the escaped path to fetch for module p, whose escaped
+// path is upstreamPath: that of its source, if it has one.
+func (d *cloneDef) fetchPath(p, upstreamPath string) string {
+	s := d.source(p)
+	if s == nil {
+		return upstreamPath
+	}
+	ep, err := module.EscapePath(s.Source)
+	if err != nil {
+		return upstreamPath
+	}
+	return ep
+}
+
+// allowSourceVersion returns a not found error if the source of module p
+// is pinned to a version other than v.
+func (d *cloneDef) allowSourceVersion(p, v string) error {
+	if s := d.source(p); s != nil && s.Version != "" && v != s.Version {
+		return notFound("%s@%s: clone %s only serves %s@%s", p, v, d.Name, s.Source, s.Version)
+	}
+	return nil
+}
+
+// sourcePinner is the transform that requires the modules whose sources
+// a clone pins at the pinned versions, the only ones the clone serves, so
+// that other modules of the clone requiring other versions still build.
+type sourcePinner struct {
+	// versions maps the rewritten path of each pinned module to its
+	// version.
+	versions map[string]string
+	// paths are the original paths of the pinned modules.
+	paths [][]byte
+}
+
+// newSourcePinner returns the transform pinning the sources of d that repl
+// clones, or nil if there are none.
+func newSourcePinner(d *cloneDef, repl map[string]string) *sourcePinner {
+	if d == nil {
+		return nil
+	}
+	x := &sourcePinner{versions: map[string]string{}}
+	for _, s := range d.Sources {
+		if newPath, ok := repl[s.Module]; ok && s.Version != "" {
+			x.versions[newPath] = s.Version
+			x.paths = append(x.paths, []byte(s.Module))
+		}
+	}
+	if len(x.paths) == 0 {
+		return nil
+	}
+	return x
+}
+
+func (x *sourcePinner) mayApply(src []byte) bool {
+	for _, p := range x.paths {
+		if bytes.Contains(src, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *sourcePinner) applyMod(f *modfile.File) (bool, error) {
+	changed := false
+	for _, r := range slices.Clone(f.Require) {
+		if v, ok := x.versions[r.Mod.Path]; ok && r.Mod.Version != v {
+			if err := f.AddRequire(r.Mod.Path, v); err != nil {
+				return false, err
+			}
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// versionCloneRE matches clone names that pin a version by convention:
+// "_v1" serves v1.x.x, "_v0.3" serves v0.3.x and "_v1.2.3" serves v1.2.3.
+// Standard library clones name Go releases instead, as in "_go1.21", which
+// serves v1.21.x.
+var versionCloneRE = regexp.MustCompile(`^_(v|go)(\d+)(?:\.(\d+))?(?:\.(\d+))?$`)
+
+// cloneDefFor returns the definition for module p under the clone name, or
+// nil if there is none. Clone names following the version naming
+// convention get a definition restricting their versions.
+func cloneDefFor(clone, p string) *cloneDef {
+	for i, d := range conf.Clones {
+		if d.Name == clone && (d.Modules == "" || module.MatchPrefixPatterns(d.Modules, p)) {
+			return &conf.Clones[i]
+		}
+	}
+	for i, d := range conf.Clones {
+		if d.Name == clone && module.MatchPrefixPatterns(d.Recursive, p) {
+			return conf.Clones[i].dependencyDef()
+		}
+	}
+	m := versionCloneRE.FindStringSubmatch(clone)
+	if m == nil || m[1] == "go" && !strings.HasPrefix(p, stdPrefix) {
+		return nil
+	}
+	m = m[1:]
+	// Using the lowest prerelease as the bounds includes the prereleases
+	// and pseudo-versions of the pinned versions, but not those of the next.
+	var spec string
+	switch {
+	case m[3] != "":
+		spec = fmt.Sprintf("v%s.%s.%s", m[1], m[2], m[3])
+	case m[2] != "":
+		minor, _ := strconv.Atoi(m[2])
+		spec = fmt.Sprintf(">=v%s.%s.0-0, <v%s.%d.0-0", m[1], m[2], m[1], minor+1)
+	default:
+		major, _ := strconv.Atoi(m[1])
+		spec = fmt.Sprintf(">=v%s.0.0-0, <v%d.0.0-0", m[1], major+1)
+	}
+	c, err := parseVersionConstraint(spec)
+	if err != nil {
+		return nil
+	}
+	return &cloneDef{Name: clone, Versions: c}
+}
+
+// dependencyDef returns the definition for the dependencies d clones along
+// with its modules: they clone the same dependencies, and take their code
+// from the sources d names for them, but the versions, patches and other
+// changes d makes are for its own modules.
+func (d *cloneDef) dependencyDef() *cloneDef {
+	return &cloneDef{Name: d.Name, Recursive: d.Recursive, Deep: d.Deep, Sources: d.Sources}
+}
+
+// allowVersion returns a not found error if version v is outside the
+// versions of the clone.
+func (d *cloneDef) allowVersion(p, v string) error {
+	if d == nil || d.Versions.allows(v) {
+		return nil
+	}
+	return notFound("%s@%s is outside the versions served by clone %s (%s)", p, v, d.Name, d.Versions)
+}
+
+// configuredDeps returns the dependencies in modData that the definition
+// says to clone along with the module. Patterns without wildcards name a
+// module even if it isn't required directly, since older go.mod files leave
+// out indirect requirements.
+func (d *cloneDef) configuredDeps(modData []byte) ([]string, error) {
+	if d == nil || d.Recursive == "" {
+		return nil, nil
+	}
+	f, err := modfile.Parse("go.mod", modData, nil)
+	if err != nil {
+		return nil, err
+	}
+	var deps []string
+	for _, r := range f.Require {
+		if module.MatchPrefixPatterns(d.Recursive, r.Mod.Path) {
+			deps = append(deps, r.Mod.Path)
+		}
+	}
+	for _, pat := range strings.Split(d.Recursive, ",") {
+		pat = strings.TrimSuffix(strings.TrimSpace(pat), "/")
+		if pat != "" && !strings.ContainsAny(pat, `*?[\`) {
+			deps = append(deps, pat)
+		}
+	}
+	return deps, nil
+}
+
+// maxFamily bounds the number of modules in a deep clone family.
+const maxFamily = 1000
+
+// directDeps returns the dependencies in modData to clone along with the
+// module, whether marked in go.mod or named by the definition, less those
+// go.mod says to keep.
+func (d *cloneDef) directDeps(modData []byte) ([]string, error) {
+	dirs, err := parseDirectives(modData)
+	if err != nil {
+		return nil, err
+	}
+	more, err := d.configuredDeps(modData)
+	if err != nil {
+		return nil, err
+	}
+	keep := map[string]bool{}
+	for _, p := range dirs.keep {
+		keep[p] = true
+	}
+	var deps []string
+	for _, p := range append(dirs.recursive, more...) {
+		if !keep[p] {
+			deps = append(deps, p)
+		}
+	}
+	return deps, nil
+}
+
+// familyDeps returns the dependencies to clone along with the module whose
+// go.mod is modData. For deep definitions that includes the dependencies of
+// those dependencies, found by walking their go.mod files at the versions
+// required, so that a module version always has the same family.
+func (d *cloneDef) familyDeps(modData []byte) ([]string, error) {
+	if d == nil || !d.Deep {
+		return d.directDeps(modData)
+	}
+	return d.walkFamily(modData)
+}
+
+// walkFamily returns the dependencies to clone along with the module whose
+// go.mod is modData and, transitively, along with those: the dependencies
+// of each are found by walking their go.mod files at the required versions.
+// Each module is visited once, so cycles in the module graph end the walk.
+func (d *cloneDef) walkFamily(modData []byte) ([]string, error) {
+	seen := map[string]bool{}
+	if f, err := modfile.Parse("go.mod", modData, nil); err == nil && f.Module != nil {
+		seen[f.Module.Mod.Path] = true
+	}
+	var deps []string
+	queue := [][]byte{modData}
+	for len(queue) > 0 {
+		data := queue[0]
+		queue = queue[1:]
+		f, err := modfile.Parse("go.mod", data, nil)
+		if err != nil {
+			return nil, err
+		}
+		required := map[string]string{}
+		for _, r := range f.Require {
+			required[r.Mod.Path] = r.Mod.Version
+		}
+		direct, err := d.directDeps(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, dep := range direct {
+			if seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			deps = append(deps, dep)
+			if len(seen) > maxFamily {
+				return nil, fmt.Errorf("clone family of %s has more than %d modules", d.Name, maxFamily)
+			}
+			v, ok := required[dep]
+			if !ok {
+				continue
+			}
+			depMod, err := fetchGoMod(dep, v)
+			if err != nil {
+				return nil, fmt.Errorf("walking clone family: %w", err)
+			}
+			queue = append(queue, depMod)
+		}
+	}
+	return deps, nil
+}
+
+// fetchGoMod returns the go.mod file of module p at version v from its
+// upstream.
+func fetchGoMod(p, v string) ([]byte, error) {
+	ep, err := module.EscapePath(p)
+	if err != nil {
+		return nil, err
+	}
+	ev, err := module.EscapeVersion(v)
+	if err != nil {
+		return nil, err
+	}
+	a, err := fetchUpstream(ep, ev+".mod")
+	if err != nil {
+		return nil, err
+	}
+	if a.status != http.StatusOK {
+		return nil, &statusError{http.StatusBadGateway, fmt.Errorf("%s@%s: upstream returned %d", p, v, a.status)}
+	}
+	return a.body, nil
+}
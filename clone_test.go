@@ -0,0 +1,435 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestCloneDefForConvention(t *testing.T) {
+	tests := []struct {
+		clone   string
+		allowed []string
+		denied  []string
+	}{
+		{"_v1", []string{"v1.0.0", "v1.9.0", "v1.0.0-rc.1", "v1.2.1-0.20230101000000-abcdefabcdef"}, []string{"v0.9.0", "v2.0.0", "v2.0.0-rc.1"}},
+		{"_v0.3", []string{"v0.3.0", "v0.3.9", "v0.3.1-0.20230101000000-abcdefabcdef"}, []string{"v0.2.9", "v0.4.0", "v0.4.0-rc.1"}},
+		{"_v1.2.3", []string{"v1.2.3"}, []string{"v1.2.4"}},
+	}
+	for _, tt := range tests {
+		d := cloneDefFor(tt.clone, "example.com/mod")
+		if d == nil {
+			t.Fatalf("%s: no definition", tt.clone)
+		}
+		for _, v := range tt.allowed {
+			if err := d.allowVersion("example.com/mod", v); err != nil {
+				t.Errorf("%s should allow %s: %v", tt.clone, v, err)
+			}
+		}
+		for _, v := range tt.denied {
+			if d.allowVersion("example.com/mod", v) == nil {
+				t.Errorf("%s should not allow %s", tt.clone, v)
+			}
+		}
+	}
+	for _, clone := range []string{"", "_two", "_v", "_vx", "_v1.2.3.4"} {
+		if d := cloneDefFor(clone, "example.com/mod"); d != nil {
+			t.Errorf("%s: unexpected definition %+v", clone, d)
+		}
+	}
+}
+
+func TestCloneDefForConfig(t *testing.T) {
+	defer func(c *config) { conf = c }(conf)
+	conf = &config{Clones: []cloneDef{
+		{Name: "_legacy", Modules: "golang.org/x/text", Versions: mustConstraint(t, "<v0.4.0")},
+		{Name: "_v1", Modules: "example.com/special"},
+	}}
+	if d := cloneDefFor("_legacy", "golang.org/x/text"); d == nil || d.allowVersion("golang.org/x/text", "v0.4.0") == nil {
+		t.Errorf("expected _legacy to stop at v0.4.0, got %+v", d)
+	}
+	if d := cloneDefFor("_legacy", "golang.org/x/net"); d != nil {
+		t.Errorf("expected no definition for other modules, got %+v", d)
+	}
+	if d := cloneDefFor("_v1", "example.com/special"); d == nil || d.Versions != nil {
+		t.Errorf("expected configuration to override naming convention, got %+v", d)
+	}
+}
+
+func TestProxyHandlerVersionPinnedClone(t *testing.T) {
+	mux := http.NewServeMux()
+	for _, v := range []string{"v1.0.0", "v1.0.1", "v1.1.0"} {
+		mod, info, zipData := buildModule(t, v)
+		mux.HandleFunc("/example.com/mod/@v/"+v+".mod", func(w http.ResponseWriter, r *http.Request) { w.Write(mod) })
+		mux.HandleFunc("/example.com/mod/@v/"+v+".info", func(w http.ResponseWriter, r *http.Request) { w.Write(info) })
+		mux.HandleFunc("/example.com/mod/@v/"+v+".zip", func(w http.ResponseWriter, r *http.Request) { w.Write(zipData) })
+	}
+	mux.HandleFunc("/example.com/mod/@v/list", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "v1.0.0\nv1.0.1\nv1.1.0\n")
+	})
+	mux.HandleFunc("/example.com/mod/@latest", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"Version":"v1.1.0","Time":"2023-01-01T00:00:00Z"}`)
+	})
+	serveUpstream(t, mux)
+
+	get := func(rest string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_v1.0/example.com/mod/"+rest, nil))
+		return w
+	}
+	if w := get("@v/list"); w.Body.String() != "v1.0.0\nv1.0.1\n" {
+		t.Errorf("list not filtered: %q", w.Body)
+	}
+	if w := get("@latest"); !strings.Contains(w.Body.String(), `"v1.0.1"`) {
+		t.Errorf("unexpected latest: %d %s", w.Code, w.Body)
+	}
+	for _, rest := range []string{"@v/v1.1.0.info", "@v/v1.1.0.mod", "@v/v1.1.0.zip"} {
+		if w := get(rest); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "clone _v1.0") {
+			t.Errorf("%s: expected 404, got %d: %s", rest, w.Code, w.Body)
+		}
+	}
+	if w := get("@v/v1.0.1.zip"); w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestCloneDefRecursive(t *testing.T) {
+	useUpstream(t, "off")
+	conf = &config{Clones: []cloneDef{
+		{Name: "_rc", Modules: "example.com/b", Recursive: "example.com/a,example.com/x*"},
+	}}
+	bMod := []byte("module example.com/b\n\nrequire (\n\texample.com/a v1.0.0\n\texample.com/xyz v1.0.0\n\texample.com/other v1.0.0\n)\n")
+	repl, err := makeReplacements("_rc/example.com/b", "example.com/b", bMod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"example.com/b":   "goclone.example.com/_rc/example.com/b",
+		"example.com/a":   "goclone.example.com/_rc/example.com/a",
+		"example.com/xyz": "goclone.example.com/_rc/example.com/xyz",
+	}
+	if fmt.Sprint(repl) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", repl, want)
+	}
+
+	// The co-cloned dependency is part of the clone family, so its own
+	// dependencies matching the patterns are cloned too.
+	aMod := []byte("module example.com/a\n\nrequire example.com/xa v1.0.0\n")
+	repl, err = makeReplacements("_rc/example.com/a", "example.com/a", aMod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repl["example.com/xa"] != "goclone.example.com/_rc/example.com/xa" {
+		t.Errorf("dependency of family member not cloned: %v", repl)
+	}
+
+	// Other clone names are unaffected.
+	repl, err = makeReplacements("_other/example.com/b", "example.com/b", bMod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repl) != 1 {
+		t.Errorf("unexpected replacements for other clone: %v", repl)
+	}
+}
+
+func TestCloneDefRecursiveVersions(t *testing.T) {
+	mods := map[string]string{
+		"example.com/vr/root@v0.3.0": "module example.com/vr/root\n\nrequire example.com/vr/net v1.0.0\n",
+		"example.com/vr/root@v1.0.0": "module example.com/vr/root\n",
+		"example.com/vr/net@v1.0.0":  "module example.com/vr/net\n",
+	}
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, v, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/@v/")
+		if m, ok := mods[p+"@"+strings.TrimSuffix(v, ".mod")]; ok {
+			fmt.Fprint(w, m)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	conf = &config{Clones: []cloneDef{
+		{Name: "_vr", Modules: "example.com/vr/root", Versions: mustConstraint(t, "<v0.4.0"), Recursive: "example.com/vr/net", Slim: []string{"tests"}},
+	}}
+
+	get := func(rest string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_vr/"+rest, nil))
+		return w
+	}
+	if w := get("example.com/vr/root/@v/v0.3.0.mod"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goclone.example.com/_vr/example.com/vr/net v1.0.0") {
+		t.Errorf("root: %d %s", w.Code, w.Body)
+	}
+	if w := get("example.com/vr/root/@v/v1.0.0.mod"); w.Code != http.StatusNotFound {
+		t.Errorf("root outside its versions: got %d, want 404", w.Code)
+	}
+	// The range is the root's: the dependency is served at the version the
+	// root requires.
+	if w := get("example.com/vr/net/@v/v1.0.0.mod"); w.Code != http.StatusOK {
+		t.Errorf("dependency: %d %s", w.Code, w.Body)
+	}
+	if d := cloneDefFor("_vr", "example.com/vr/net"); d == nil || d.Versions != nil || d.Slim != nil || d.Recursive != "example.com/vr/net" {
+		t.Errorf("dependency definition %+v", d)
+	}
+}
+
+func TestCloneDefDeep(t *testing.T) {
+	// a clones b, b clones c, and c clones a again.
+	mods := map[string]string{
+		"example.com/a": "module example.com/a\n\nrequire (\n\texample.com/b v1.0.0 // goclone:recursive\n\texample.com/c v1.0.0 // indirect\n)\n",
+		"example.com/b": "module example.com/b\n\nrequire example.com/c v1.1.0 // goclone:recursive\n",
+		"example.com/c": "module example.com/c\n\nrequire example.com/a v1.0.0 // goclone:recursive\n",
+	}
+	var fetched []string
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, v, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/@v/")
+		fetched = append(fetched, p+"@"+v)
+		if m, ok := mods[p]; ok {
+			fmt.Fprint(w, m)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	conf = &config{Clones: []cloneDef{{Name: "_deep", Deep: true}}}
+
+	repl, err := makeReplacements("_deep/example.com/a", "example.com/a", []byte(mods["example.com/a"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"example.com/a", "example.com/b", "example.com/c"} {
+		if repl[p] != "goclone.example.com/_deep/"+p {
+			t.Errorf("%s not cloned: %v", p, repl)
+		}
+	}
+	if want := "[example.com/b@v1.0.0.mod example.com/c@v1.1.0.mod]"; fmt.Sprint(fetched) != want {
+		t.Errorf("fetched %v, want %v", fetched, want)
+	}
+
+	// Without deep, only a's own marker counts.
+	repl, err = makeReplacements("_shallow/example.com/a", "example.com/a", []byte(mods["example.com/a"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := repl["example.com/c"]; ok {
+		t.Errorf("unexpected deep clone: %v", repl)
+	}
+
+	delete(mods, "example.com/c")
+	if _, err := makeReplacements("_deep/example.com/a", "example.com/a", []byte(mods["example.com/a"])); err == nil {
+		t.Error("expected error when a family member's go.mod can't be fetched")
+	}
+}
+
+func TestCloneDefDeepFamily(t *testing.T) {
+	// a clones b and d; b requires d but doesn't mark it.
+	mods := map[string]string{
+		"example.com/fam/a": "module example.com/fam/a\n\nrequire (\n\texample.com/fam/b v1.0.0 // goclone:recursive\n\texample.com/fam/d v1.0.0 // goclone:recursive\n)\n",
+		"example.com/fam/b": "module example.com/fam/b\n\nrequire example.com/fam/d v1.0.0\n",
+		"example.com/fam/d": "module example.com/fam/d\n",
+	}
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/@v/")
+		if m, ok := mods[p]; ok {
+			fmt.Fprint(w, m)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	conf = &config{Clones: []cloneDef{{Name: "_fam", Deep: true}}}
+
+	// A module version's family comes from its own go.mod graph, whatever
+	// else has been served, so its rewritten files never change.
+	bRepl := func() string {
+		repl, err := makeReplacements("_fam/example.com/fam/b", "example.com/fam/b", []byte(mods["example.com/fam/b"]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(repl)
+	}
+	before := bRepl()
+	if _, err := makeReplacements("_fam/example.com/fam/a", "example.com/fam/a", []byte(mods["example.com/fam/a"])); err != nil {
+		t.Fatal(err)
+	}
+	if after := bRepl(); after != before {
+		t.Errorf("b's replacements changed after serving a:\n%s\nwant\n%s", after, before)
+	}
+}
+
+func TestCloneDefSourcesCheck(t *testing.T) {
+	for _, s := range []moduleSource{
+		{Module: "golang.org/x/net"},
+		{Module: "golang.org/x/net", Source: "not a path"},
+		{Module: "golang.org/x/net", Source: "github.com/ourorg/net", Version: "v1"},
+		{Module: "golang.org/x/net", Source: "github.com/ourorg/net", Version: "v2.0.0"},
+	} {
+		d := &cloneDef{Name: "_patched", Sources: []moduleSource{s}}
+		if err := d.check(); err == nil {
+			t.Errorf("%+v: expected an error", s)
+		}
+	}
+	d := &cloneDef{Name: "_patched", Sources: []moduleSource{{Module: "golang.org/x/net", Source: "github.com/ourorg/net", Version: "v0.0.0-20240101000000-abcdefabcdef"}}}
+	if err := d.check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProxyHandlerSource(t *testing.T) {
+	const pinned = "v0.0.0-20240101000000-abcdefabcdef"
+	files := map[string]string{
+		"go.mod":   "module example.com/fork\n",
+		"a.go":     "package orig\n\nimport (\n\t\"example.com/fork/sub\"\n\t\"example.com/orig/sub2\"\n)\n\nvar _, _ = sub.X, sub2.Y\n",
+		"sub/b.go": "package sub\n\nconst X = 1\n",
+	}
+	mux := http.NewServeMux()
+	for _, v := range []string{"v1.0.0", pinned} {
+		zipData := buildZip(t, "example.com/fork@"+v+"/", files)
+		mux.HandleFunc("/example.com/fork/@v/"+v+".mod", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, files["go.mod"]) })
+		mux.HandleFunc("/example.com/fork/@v/"+v+".info", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{"Version":%q,"Time":"2024-01-01T00:00:00Z"}`, v)
+		})
+		mux.HandleFunc("/example.com/fork/@v/"+v+".zip", func(w http.ResponseWriter, r *http.Request) { w.Write(zipData) })
+	}
+	mux.HandleFunc("/example.com/fork/@v/list", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "v1.0.0\n") })
+	serveUpstream(t, mux)
+	conf = &config{Clones: []cloneDef{
+		{Name: "_patched", Sources: []moduleSource{{Module: "example.com/orig", Source: "example.com/fork"}}},
+		{Name: "_pinned", Sources: []moduleSource{{Module: "example.com/orig", Source: "example.com/fork", Version: pinned}}},
+	}}
+
+	get := func(clone, rest string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/"+clone+"/example.com/orig/"+rest, nil))
+		return w
+	}
+	if w := get("_patched", "@v/list"); w.Body.String() != "v1.0.0\n" {
+		t.Errorf("list: %d %q", w.Code, w.Body)
+	}
+	if w := get("_patched", "@v/v1.0.0.mod"); w.Body.String() != "module goclone.example.com/_patched/example.com/orig\n" {
+		t.Errorf("mod: %d %q", w.Code, w.Body)
+	}
+	w := get("_patched", "@v/v1.0.0.zip")
+	if w.Code != http.StatusOK {
+		t.Fatalf("zip: %d %s", w.Code, w.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if !strings.HasPrefix(f.Name, "goclone.example.com/_patched/example.com/orig@v1.0.0/") {
+			t.Errorf("unexpected entry %s", f.Name)
+		}
+		if path.Base(f.Name) == "a.go" {
+			src, _ := readZipFile(f)
+			for _, imp := range []string{`"goclone.example.com/_patched/example.com/orig/sub"`, `"goclone.example.com/_patched/example.com/orig/sub2"`} {
+				if !bytes.Contains(src, []byte(imp)) {
+					t.Errorf("a.go doesn't import %s:\n%s", imp, src)
+				}
+			}
+		}
+	}
+
+	if w := get("_pinned", "@v/list"); w.Body.String() != pinned+"\n" {
+		t.Errorf("pinned list: %d %q", w.Code, w.Body)
+	}
+	if w := get("_pinned", "@latest"); !strings.Contains(w.Body.String(), pinned) {
+		t.Errorf("pinned latest: %d %s", w.Code, w.Body)
+	}
+	if w := get("_pinned", "@v/"+pinned+".zip"); w.Code != http.StatusOK {
+		t.Errorf("pinned zip: %d %s", w.Code, w.Body)
+	}
+	if w := get("_pinned", "@v/v1.0.0.mod"); w.Code != http.StatusNotFound {
+		t.Errorf("unpinned version: got %d, want 404", w.Code)
+	}
+}
+
+func TestProxyHandlerPinnedSourceFamily(t *testing.T) {
+	// app requires lib at a release; the clone serves lib only at a
+	// commit of its fork.
+	const pinned = "v0.0.0-20240101000000-abcdefabcdef"
+	appMod := "module example.com/pinapp\n\nrequire example.com/pinlib v1.2.0 // goclone:recursive\n"
+	appZip := buildZip(t, "example.com/pinapp@v1.0.0/", map[string]string{
+		"go.mod": appMod,
+		"a.go":   "package pinapp\n\nimport _ \"example.com/pinlib\"\n",
+	})
+	libMod := "module example.com/pinlib\n"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/example.com/pinapp/@v/v1.0.0.mod", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, appMod) })
+	mux.HandleFunc("/example.com/pinapp/@v/v1.0.0.zip", func(w http.ResponseWriter, r *http.Request) { w.Write(appZip) })
+	mux.HandleFunc("/example.com/pinfork/@v/"+pinned+".mod", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, libMod) })
+	serveUpstream(t, mux)
+	conf = &config{Clones: []cloneDef{
+		{Name: "_pinfam", Sources: []moduleSource{{Module: "example.com/pinlib", Source: "example.com/pinfork", Version: pinned}}},
+	}}
+
+	get := func(rest string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_pinfam/"+rest, nil))
+		return w
+	}
+	want := "require goclone.example.com/_pinfam/example.com/pinlib " + pinned
+	w := get("example.com/pinapp/@v/v1.0.0.mod")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), want) {
+		t.Errorf("app mod: %d %s", w.Code, w.Body)
+	}
+	w = get("example.com/pinapp/@v/v1.0.0.zip")
+	if w.Code != http.StatusOK {
+		t.Fatalf("app zip: %d %s", w.Code, w.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if path.Base(f.Name) == "go.mod" {
+			if src, _ := readZipFile(f); !strings.Contains(string(src), want) {
+				t.Errorf("app zip go.mod:\n%s", src)
+			}
+		}
+	}
+	// The version app now requires is the one the clone serves.
+	if w := get("example.com/pinlib/@v/" + pinned + ".mod"); w.Code != http.StatusOK {
+		t.Errorf("lib mod: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestProxyHandlerSourceUpperCase(t *testing.T) {
+	// Zip entries and imports use the fork's path unescaped.
+	files := map[string]string{
+		"go.mod":   "module example.com/OurOrg/net\n",
+		"a.go":     "package net\n\nimport \"example.com/OurOrg/net/sub\"\n\nvar _ = sub.X\n",
+		"sub/b.go": "package sub\n\nconst X = 1\n",
+	}
+	zipData := buildZip(t, "example.com/OurOrg/net@v1.0.0/", files)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/example.com/!our!org/net/@v/v1.0.0.mod", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, files["go.mod"]) })
+	mux.HandleFunc("/example.com/!our!org/net/@v/v1.0.0.zip", func(w http.ResponseWriter, r *http.Request) { w.Write(zipData) })
+	serveUpstream(t, mux)
+	conf = &config{Clones: []cloneDef{
+		{Name: "_upper", Sources: []moduleSource{{Module: "example.com/upnet", Source: "example.com/OurOrg/net"}}},
+	}}
+
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_upper/example.com/upnet/@v/v1.0.0.zip", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("zip: %d %s", w.Code, w.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if !strings.HasPrefix(f.Name, "goclone.example.com/_upper/example.com/upnet@v1.0.0/") {
+			t.Errorf("unexpected entry %s", f.Name)
+		}
+		if path.Base(f.Name) == "a.go" {
+			if src, _ := readZipFile(f); !bytes.Contains(src, []byte(`"goclone.example.com/_upper/example.com/upnet/sub"`)) {
+				t.Errorf("self-import not rewritten:\n%s", src)
+			}
+		}
+	}
+}
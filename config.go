@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"golang.org/x/mod/module"
+)
+
+// config is the server configuration file given with -config.
+type config struct {
+	// Upstreams route modules to their own upstreams. The first rule whose
+	// pattern matches a module is used; modules matching no rule use
+	// -upstream.
+	Upstreams []upstreamRule `json:"upstreams"`
+	// Clients may use the server. If there are none, anyone may.
+	Clients []client `json:"clients"`
+	// Clones configure clone names.
+	Clones []cloneDef `json:"clones"`
+}
+
+// upstreamRule sends the modules matching a pattern to an upstream, with
+// optional credentials.
+type upstreamRule struct {
+	// Modules is a comma-separated list of module path glob patterns,
+	// matched like GOPRIVATE.
+	Modules string `json:"modules"`
+	// Upstream is a list of upstreams in GOPROXY syntax.
+	Upstream string       `json:"upstream"`
+	Auth     *credentials `json:"auth,omitempty"`
+}
+
+// conf is the loaded configuration. It is replaced as a whole, never
+// modified in place.
+var conf = &config{}
+
+func loadConfig(file string) (*config, error) {
+	c := &config{}
+	if file == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := c.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return c, nil
+}
+
+func (c *config) check() error {
+	for i, r := range c.Upstreams {
+		if r.Modules == "" {
+			return fmt.Errorf("upstreams[%d]: missing modules", i)
+		}
+		if _, err := parseUpstreamAuth(r.Upstream, r.Auth); err != nil {
+			return fmt.Errorf("upstreams[%d]: %v", i, err)
+		}
+		if err := r.Auth.check(); err != nil {
+			return fmt.Errorf("upstreams[%d]: %v", i, err)
+		}
+	}
+	for i, c := range c.Clients {
+		if err := c.check(); err != nil {
+			return fmt.Errorf("clients[%d]: %v", i, err)
+		}
+	}
+	for i := range c.Clones {
+		if err := c.Clones[i].check(); err != nil {
+			return fmt.Errorf("clones[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// upstreamRule returns the first upstream rule matching module p, or nil.
+func (c *config) upstreamRule(p string) *upstreamRule {
+	for i, r := range c.Upstreams {
+		if module.MatchPrefixPatterns(r.Modules, p) {
+			return &c.Upstreams[i]
+		}
+	}
+	return nil
+}
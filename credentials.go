@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentials authenticate goclone to an upstream proxy. Exactly one kind
+// should be set. Secret values can be given literally or, preferably, named
+// by environment variable.
+type credentials struct {
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+	PasswordEnv string `json:"passwordEnv,omitempty"`
+	Token       string `json:"token,omitempty"`
+	TokenEnv    string `json:"tokenEnv,omitempty"`
+	// Netrc is the path of a .netrc file to take the login for the
+	// upstream's host from.
+	Netrc string `json:"netrc,omitempty"`
+	// Helper is a credential helper command following the GOAUTH protocol:
+	// it is run with the URL as its argument and prints the headers to
+	// send.
+	Helper string `json:"helper,omitempty"`
+}
+
+// String names the kind of credentials without revealing them, so they are
+// safe to print by accident.
+func (c *credentials) String() string {
+	switch {
+	case c == nil:
+		return "none"
+	case c.Username != "":
+		return "basic auth for " + c.Username
+	case c.Token != "" || c.TokenEnv != "":
+		return "bearer token"
+	case c.Netrc != "":
+		return "netrc " + c.Netrc
+	case c.Helper != "":
+		return "credential helper"
+	}
+	return "none"
+}
+
+func (c *credentials) GoString() string { return c.String() }
+
+func (c *credentials) check() error {
+	if c == nil {
+		return nil
+	}
+	n := 0
+	for _, set := range []bool{
+		c.Username != "" || c.Password != "" || c.PasswordEnv != "",
+		c.Token != "" || c.TokenEnv != "",
+		c.Netrc != "",
+		c.Helper != "",
+	} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("auth needs exactly one of username, token, netrc or helper")
+	}
+	if (c.Password != "" || c.PasswordEnv != "") && c.Username == "" {
+		return errors.New("auth password needs a username")
+	}
+	return nil
+}
+
+func secret(value, env string) (string, error) {
+	if env == "" {
+		return value, nil
+	}
+	v, ok := os.LookupEnv(env)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", env)
+	}
+	return v, nil
+}
+
+// apply adds the credentials to req. Errors never include secret values.
+func (c *credentials) apply(req *http.Request) error {
+	if c == nil {
+		return nil
+	}
+	switch {
+	case c.Username != "":
+		pw, err := secret(c.Password, c.PasswordEnv)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(c.Username, pw)
+	case c.Token != "" || c.TokenEnv != "":
+		tok, err := secret(c.Token, c.TokenEnv)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+tok)
+	case c.Netrc != "":
+		data, err := os.ReadFile(c.Netrc)
+		if err != nil {
+			return fmt.Errorf("reading netrc: %v", err)
+		}
+		if login, pw, ok := netrcLogin(data, req.URL.Hostname()); ok {
+			req.SetBasicAuth(login, pw)
+		}
+	case c.Helper != "":
+		h, err := helperHeaders(c.Helper, req.URL)
+		if err != nil {
+			return err
+		}
+		for k, v := range h {
+			req.Header[k] = v
+		}
+	}
+	return nil
+}
+
+// netrcLogin returns the login and password for host from a .netrc file.
+func netrcLogin(data []byte, host string) (login, password string, ok bool) {
+	fields := strings.Fields(string(data))
+	match := false
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine", "default":
+			if match && login != "" {
+				return login, password, true
+			}
+			login, password = "", ""
+			match = fields[i] == "default"
+			if fields[i] == "machine" && i+1 < len(fields) {
+				i++
+				match = fields[i] == host
+			}
+		case "login":
+			if i+1 < len(fields) {
+				i++
+				login = fields[i]
+			}
+		case "password":
+			if i+1 < len(fields) {
+				i++
+				password = fields[i]
+			}
+		}
+	}
+	if match && login != "" {
+		return login, password, true
+	}
+	return "", "", false
+}
+
+// helperTTL is how long headers from a credential helper are reused.
+const helperTTL = 5 * time.Minute
+
+type helperResult struct {
+	prefixes []string
+	header   http.Header
+	expires  time.Time
+}
+
+var (
+	helperMu    sync.Mutex
+	helperCache = map[string][]helperResult{} // by helper command
+)
+
+// helperHeaders runs a GOAUTH-style credential helper for u, or reuses its
+// earlier answer for a matching URL prefix.
+func helperHeaders(helper string, u *url.URL) (http.Header, error) {
+	target := u.Scheme + "://" + u.Host + u.Path
+	helperMu.Lock()
+	defer helperMu.Unlock()
+	for _, r := range helperCache[helper] {
+		if time.Now().After(r.expires) {
+			continue
+		}
+		for _, p := range r.prefixes {
+			if strings.HasPrefix(target, p) {
+				return r.header, nil
+			}
+		}
+	}
+	args := strings.Fields(helper)
+	if len(args) == 0 {
+		return nil, errors.New("empty credential helper")
+	}
+	cmd := exec.Command(args[0], append(args[1:], target)...)
+	out, err := cmd.Output()
+	if err != nil {
+		// The helper's output may hold secrets, so leave it out.
+		return nil, fmt.Errorf("credential helper %s failed: %v", args[0], err)
+	}
+	results, err := parseHelperOutput(out)
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %s: %v", args[0], err)
+	}
+	cached := helperCache[helper][:0]
+	for _, r := range helperCache[helper] {
+		if time.Now().Before(r.expires) {
+			cached = append(cached, r)
+		}
+	}
+	helperCache[helper] = append(cached, results...)
+	for _, r := range results {
+		for _, p := range r.prefixes {
+			if strings.HasPrefix(target, p) {
+				return r.header, nil
+			}
+		}
+	}
+	return http.Header{}, nil
+}
+
+// parseHelperOutput parses the GOAUTH credential helper format: blocks of
+// one or more URL prefixes, a blank line, header lines, and a blank line.
+func parseHelperOutput(out []byte) ([]helperResult, error) {
+	var results []helperResult
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	cur := helperResult{header: http.Header{}, expires: time.Now().Add(helperTTL)}
+	inHeaders := false
+	flush := func() {
+		if len(cur.prefixes) > 0 {
+			results = append(results, cur)
+		}
+		cur = helperResult{header: http.Header{}, expires: cur.expires}
+		inHeaders = false
+	}
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		switch {
+		case line == "" && inHeaders:
+			flush()
+		case line == "":
+			inHeaders = len(cur.prefixes) > 0
+		case inHeaders:
+			k, v, ok := strings.Cut(line, ":")
+			if !ok {
+				return nil, errors.New("malformed header line")
+			}
+			cur.header.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+		default:
+			if _, err := url.Parse(line); err != nil {
+				return nil, errors.New("malformed URL line")
+			}
+			cur.prefixes = append(cur.prefixes, line)
+		}
+	}
+	flush()
+	return results, sc.Err()
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// A clone that doesn't also clone a dependency whose types or package-level
+// state appear in its exported API shares that state with the original,
+// which defeats the point of cloning. The analysis here finds such
+// dependencies from the module zip alone: each package is type-checked
+// against stub imports, which is enough to resolve which import every
+// qualified identifier in an exported declaration refers to, even where the
+// import is renamed or shadowed.
+
+// depsReport lists the dependencies that leak through a module's exported
+// API.
+type depsReport struct {
+	Module  string    `json:"module"`
+	Version string    `json:"version"`
+	Deps    []depLeak `json:"deps"`
+}
+
+// depLeak is a required module used by the exported API, along with the
+// uses, like "example.com/a.Client.Do: example.com/b.Request".
+type depLeak struct {
+	Module string   `json:"module"`
+	Uses   []string `json:"uses"`
+}
+
+// depsReports holds recent reports, keyed by module@version and patches,
+// since an auto-recursive clone needs one for both the .mod and the .zip.
+var depsReports = &byteCache{max: 256}
+
+// depsReportFor returns the report for upstreamPath at the escaped version
+// ev, patched with patches. zipData is the patched module zip if the caller
+// already has it.
+func depsReportFor(upstreamPath, ev string, patches *patchSet, zipData []byte) (*depsReport, error) {
+	rep := &depsReport{}
+	err := buildReport(depsReports, upstreamPath, ev, patches, zipData, rep, func(modPath, v string, zipData, modData []byte) (err error) {
+		rep.Module, rep.Version = modPath, v
+		rep.Deps, err = leakedDeps(modPath, zipData, modData)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// leakedDeps returns the modules required in modData that are used by the
+// exported API of the packages in zipData. Commands, internal packages,
+// tests and testdata are left out, since other modules can't import them.
+func leakedDeps(modPath string, zipData, modData []byte) ([]depLeak, error) {
+	mf, err := modfile.Parse("go.mod", modData, nil)
+	if err != nil {
+		return nil, err
+	}
+	var required []string
+	for _, r := range mf.Require {
+		required = append(required, r.Mod.Path)
+	}
+
+	pkgs, err := loadZipPackages(modPath, zipData, importableDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	uses := map[string]map[string]bool{}
+	for _, pkg := range pkgs {
+		for _, af := range pkg.files {
+			exportedRefs(af, func(api string, n ast.Node) {
+				ast.Inspect(n, func(n ast.Node) bool {
+					sel, ok := n.(*ast.SelectorExpr)
+					if !ok {
+						return true
+					}
+					imp, ok := pkg.qualifier(sel)
+					if !ok {
+						return true
+					}
+					mod := moduleFor(imp, required)
+					if mod == "" || mod == modPath {
+						return true
+					}
+					if uses[mod] == nil {
+						uses[mod] = map[string]bool{}
+					}
+					uses[mod][pkg.path+"."+api+": "+imp+"."+sel.Sel.Name] = true
+					return true
+				})
+			})
+		}
+	}
+
+	var leaks []depLeak
+	for mod, set := range uses {
+		l := depLeak{Module: mod}
+		for u := range set {
+			l.Uses = append(l.Uses, u)
+		}
+		sort.Strings(l.Uses)
+		leaks = append(leaks, l)
+	}
+	sort.Slice(leaks, func(i, j int) bool { return leaks[i].Module < leaks[j].Module })
+	return leaks, nil
+}
+
+// zipPackage is a package from a module zip, type-checked against stub
+// imports.
+type zipPackage struct {
+	path  string
+	fset  *token.FileSet
+	files []*ast.File
+	info  *types.Info
+}
+
+// loadZipPackages parses and type-checks the packages in zipData whose
+// directories, relative to the module root, wantDir accepts. If wantFile
+// isn't nil, only the files whose source it accepts are loaded. Test files,
+// files excluded by "//go:build ignore", and commands are left out.
+func loadZipPackages(modPath string, zipData []byte, wantDir func(dir string) bool, wantFile func(src []byte) bool) ([]*zipPackage, error) {
+	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, &statusError{http.StatusBadGateway, err}
+	}
+	dirs := map[string][]*zip.File{}
+	for _, f := range zr.File {
+		name, ok := zipRelPath(f.Name)
+		if !ok || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		if dir := path.Dir(name); wantDir(dir) {
+			dirs[dir] = append(dirs[dir], f)
+		}
+	}
+	var pkgs []*zipPackage
+	for dir, files := range dirs {
+		pkgPath := modPath
+		if dir != "." {
+			pkgPath += "/" + dir
+		}
+		fset := token.NewFileSet()
+		var parsed []*ast.File
+		for _, f := range files {
+			src, err := readZipFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if wantFile != nil && !wantFile(src) {
+				continue
+			}
+			af, err := parser.ParseFile(fset, f.Name, src, parser.ParseComments)
+			if err != nil || ignoredFile(af) {
+				continue
+			}
+			parsed = append(parsed, af)
+		}
+		if parsed = primaryPackage(parsed); len(parsed) > 0 {
+			pkgs = append(pkgs, checkFiles(pkgPath, fset, parsed))
+		}
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].path < pkgs[j].path })
+	return pkgs, nil
+}
+
+// checkFiles type-checks files, which make up the package pkgPath, against
+// stub imports. Imports of the known packages resolve to them, so that they
+// get the right names.
+func checkFiles(pkgPath string, fset *token.FileSet, files []*ast.File, known ...*types.Package) *zipPackage {
+	pkg := &zipPackage{
+		path:  pkgPath,
+		fset:  fset,
+		files: files,
+		info:  &types.Info{Uses: map[*ast.Ident]types.Object{}, Implicits: map[ast.Node]types.Object{}},
+	}
+	imp := stubImporter{}
+	for _, p := range known {
+		imp[p.Path()] = p
+	}
+	tc := &types.Config{
+		Importer:    imp,
+		FakeImportC: true,
+		Error:       func(error) {},
+	}
+	// Errors are expected, since the stubs declare nothing.
+	tc.Check(pkgPath, fset, files, pkg.info)
+	return pkg
+}
+
+// zipRelPath returns the path of a module zip entry relative to the module
+// root.
+func zipRelPath(name string) (string, bool) {
+	// Names are like "example.com/mod@v1.2.3/pkg/file.go".
+	_, name, _ = strings.Cut(name, "@")
+	_, name, ok := strings.Cut(name, "/")
+	return name, ok
+}
+
+// qualifier returns the path of the package that qualifies sel, as in
+// "pkg.Name", or false if sel isn't a qualified identifier.
+func (p *zipPackage) qualifier(sel *ast.SelectorExpr) (string, bool) {
+	id, ok := sel.X.(*ast.Ident)
+	if !ok {
+		return "", false
+	}
+	pn, ok := p.info.Uses[id].(*types.PkgName)
+	if !ok {
+		return "", false
+	}
+	return pn.Imported().Path(), true
+}
+
+// importableDir reports whether a package in dir, relative to the module
+// root, can be imported by other modules.
+func importableDir(dir string) bool {
+	if dir == "." {
+		return true
+	}
+	for _, elem := range strings.Split(dir, "/") {
+		if elem == "internal" || elem == "testdata" || elem == "vendor" || strings.HasPrefix(elem, "_") || strings.HasPrefix(elem, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// ignoredFile reports whether f is excluded from every build by a
+// "//go:build ignore" line, as generators often are.
+func ignoredFile(f *ast.File) bool {
+	for _, cg := range f.Comments {
+		if cg.Pos() >= f.Package {
+			break
+		}
+		for _, c := range cg.List {
+			if strings.HasPrefix(c.Text, "//go:build") && strings.Contains(c.Text, "ignore") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// primaryPackage returns the files of the most common package in files,
+// or none if that is a command.
+func primaryPackage(files []*ast.File) []*ast.File {
+	count := map[string]int{}
+	name := ""
+	for _, f := range files {
+		n := f.Name.Name
+		count[n]++
+		if count[n] > count[name] || count[n] == count[name] && n < name {
+			name = n
+		}
+	}
+	if name == "main" {
+		return nil
+	}
+	var out []*ast.File
+	for _, f := range files {
+		if f.Name.Name == name {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// moduleFor returns the module in required that provides package p, or "".
+func moduleFor(p string, required []string) string {
+	best := ""
+	for _, m := range required {
+		if (p == m || strings.HasPrefix(p, m+"/")) && len(m) > len(best) {
+			best = m
+		}
+	}
+	return best
+}
+
+// exportedRefs calls fn with each part of f's exported API, named like
+// "Client.Do", that may refer to other packages: the signatures of exported
+// functions and methods, the definitions of exported types, less their
+// unexported fields, and the types and initial values of exported
+// variables and constants.
+func exportedRefs(f *ast.File, fn func(api string, n ast.Node)) {
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if !d.Name.IsExported() {
+				continue
+			}
+			api := d.Name.Name
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				recv := receiverName(d.Recv.List[0].Type)
+				if !token.IsExported(recv) {
+					continue
+				}
+				api = recv + "." + api
+			}
+			fn(api, d.Type)
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					if !s.Name.IsExported() {
+						continue
+					}
+					if s.TypeParams != nil {
+						fn(s.Name.Name, s.TypeParams)
+					}
+					st, ok := s.Type.(*ast.StructType)
+					if !ok {
+						fn(s.Name.Name, s.Type)
+						continue
+					}
+					for _, field := range st.Fields.List {
+						if len(field.Names) == 0 {
+							fn(s.Name.Name, field.Type)
+						}
+						for _, n := range field.Names {
+							if n.IsExported() {
+								fn(s.Name.Name+"."+n.Name, field.Type)
+								break
+							}
+						}
+					}
+				case *ast.ValueSpec:
+					for _, n := range s.Names {
+						if !n.IsExported() {
+							continue
+						}
+						if s.Type != nil {
+							fn(n.Name, s.Type)
+						}
+						for _, v := range s.Values {
+							fn(n.Name, v)
+						}
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+// receiverName returns the name of the type in a method receiver.
+func receiverName(x ast.Expr) string {
+	for {
+		switch t := x.(type) {
+		case *ast.StarExpr:
+			x = t.X
+		case *ast.ParenExpr:
+			x = t.X
+		case *ast.IndexExpr:
+			x = t.X
+		case *ast.IndexListExpr:
+			x = t.X
+		case *ast.Ident:
+			return t.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// stubImporter imports every package as an empty one, named by guessing
+// from its path. Only the imports themselves matter to the analysis.
+type stubImporter map[string]*types.Package
+
+func (m stubImporter) Import(p string) (*types.Package, error) {
+	if pkg, ok := m[p]; ok {
+		return pkg, nil
+	}
+	pkg := types.NewPackage(p, guessPackageName(p))
+	pkg.MarkComplete()
+	m[p] = pkg
+	return pkg, nil
+}
+
+// guessPackageName guesses the name of the package at import path p the
+// way goimports does: the last element, skipping a major version suffix,
+// without a "go-" prefix or a ".v3" style suffix.
+func guessPackageName(p string) string {
+	elems := strings.Split(p, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		name = elems[len(elems)-2]
+	}
+	name = strings.TrimPrefix(name, "go-")
+	if i := strings.IndexAny(name, ".-"); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// buildLeakyModule returns a module whose exported API uses example.com/dep
+// and example.com/state, and which uses example.com/quiet only internally.
+func buildLeakyModule(t *testing.T) (mod, zipData []byte) {
+	t.Helper()
+	mod = []byte("module example.com/leaky\n\ngo 1.21\n\nrequire (\n\texample.com/dep v1.0.0\n\texample.com/quiet v1.0.0\n\texample.com/state/v2 v2.0.0\n)\n")
+	files := map[string]string{
+		"go.mod": string(mod),
+		"client.go": `package leaky
+
+import (
+	d "example.com/dep/api"
+	"example.com/quiet"
+	"example.com/state/v2"
+)
+
+type Client struct {
+	Req  *d.Request
+	impl quiet.Impl
+}
+
+func (c *Client) Do(ctx d.Context) error { return nil }
+
+func (c *client) Other(q quiet.Impl) {}
+
+type client struct{}
+
+var Default = state.Registry
+
+func helper(quiet quiet.Impl) {}
+`,
+		"shadow.go": `package leaky
+
+import "example.com/quiet"
+
+func Shadowed() { var quiet struct{ X int }; _ = quiet.X }
+`,
+		"internal/x/x.go":  "package x\n\nimport \"example.com/quiet\"\n\nvar V quiet.Impl\n",
+		"cmd/tool/main.go": "package main\n\nimport \"example.com/quiet\"\n\nvar V quiet.Impl\n",
+		"leaky_test.go":    "package leaky\n\nimport \"example.com/quiet\"\n\nvar T quiet.Impl\n",
+	}
+	return mod, buildZip(t, "example.com/leaky@v1.0.0/", files)
+}
+
+// buildZip returns a module zip with the given files under root.
+func buildZip(t *testing.T, root string, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, src := range files {
+		f, err := zw.Create(root + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(src))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLeakedDeps(t *testing.T) {
+	mod, zipData := buildLeakyModule(t)
+	leaks, err := leakedDeps("example.com/leaky", zipData, mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []depLeak{
+		{Module: "example.com/dep", Uses: []string{
+			"example.com/leaky.Client.Do: example.com/dep/api.Context",
+			"example.com/leaky.Client.Req: example.com/dep/api.Request",
+		}},
+		{Module: "example.com/state/v2", Uses: []string{
+			"example.com/leaky.Default: example.com/state/v2.Registry",
+		}},
+	}
+	if !reflect.DeepEqual(leaks, want) {
+		t.Errorf("got %+v, want %+v", leaks, want)
+	}
+}
+
+func TestGuessPackageName(t *testing.T) {
+	for p, want := range map[string]string{
+		"example.com/state/v2":  "state",
+		"gopkg.in/yaml.v3":      "yaml",
+		"github.com/x/go-cmp":   "cmp",
+		"github.com/x/pkg-name": "pkg",
+		"fmt":                   "fmt",
+	} {
+		if got := guessPackageName(p); got != want {
+			t.Errorf("guessPackageName(%q) = %q, want %q", p, got, want)
+		}
+	}
+}
+
+func newLeakyHandler(t *testing.T) http.Handler {
+	mod, zipData := buildLeakyModule(t)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example.com/leaky/@v/v1.0.0.mod":
+			w.Write(mod)
+		case "/example.com/leaky/@v/v1.0.0.zip":
+			w.Write(zipData)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func TestReportHandlerDeps(t *testing.T) {
+	serveUpstream(t, newLeakyHandler(t))
+
+	w := httptest.NewRecorder()
+	reportHandler(w, httptest.NewRequest("GET", "/_report/deps/goclone.example.com/_two/example.com/leaky@v1.0.0", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	var rep depsReport
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Module != "example.com/leaky" || rep.Version != "v1.0.0" || len(rep.Deps) != 2 {
+		t.Errorf("unexpected report %+v", rep)
+	}
+
+	w = httptest.NewRecorder()
+	reportHandler(w, httptest.NewRequest("GET", "/_report/deps/example.com/leaky@v9.0.0", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("missing version: got status %d, want 404", w.Code)
+	}
+}
+
+func TestProxyHandlerAutoRecursive(t *testing.T) {
+	serveUpstream(t, newLeakyHandler(t))
+	conf = &config{Clones: []cloneDef{{Name: "_auto", AutoRecursive: true}}}
+
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_auto/example.com/leaky/@v/v1.0.0.mod", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	got := w.Body.String()
+	for _, want := range []string{"goclone.example.com/_auto/example.com/dep v1.0.0", "goclone.example.com/_auto/example.com/state/v2 v2.0.0", "\texample.com/quiet v1.0.0"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("go.mod missing %q:\n%s", want, got)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_auto/example.com/leaky/@v/v1.0.0.zip", nil))
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if path.Base(f.Name) == "client.go" {
+			src, _ := readZipFile(f)
+			if !bytes.Contains(src, []byte(`"goclone.example.com/_auto/example.com/dep/api"`)) {
+				t.Errorf("import not rewritten:\n%s", src)
+			}
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// Module authors control cloning with directives in go.mod comments:
+//
+//	directive = "goclone:" verb { pattern } .
+//	verb      = "recursive" | "keep" .
+//
+// "recursive" clones a dependency along with the module, and "keep" leaves
+// it alone even if it would otherwise be cloned, for example because the
+// clone definition names it. A directive is written as a comment on, or on
+// the line above, one of:
+//
+//   - a require line: the directive applies to that requirement, and any
+//     text after it is ignored.
+//   - a "require (" line: it applies to every requirement in the block, or
+//     with patterns, to those whose module path matches one.
+//   - the module line: it applies to every requirement in the file, or with
+//     patterns, to those whose module path matches one.
+//
+// The directive may follow other text in the comment, after a space or ";",
+// like the "indirect" go mod tidy adds, and text after its patterns is
+// ignored. Patterns are module path globs, matched like GOPRIVATE. The most
+// specific directive for a requirement wins, and where two directives at
+// the same level disagree, "keep" wins.
+
+// goModDirectives are the requirements of a go.mod file that its directives
+// say to clone or keep.
+type goModDirectives struct {
+	recursive []string
+	keep      []string
+}
+
+type directive struct {
+	verb     string
+	patterns []string
+}
+
+// directiveError reports a misused directive. It is shown to clients, since
+// only the module author can fix it.
+func directiveError(c modfile.Comment, format string, args ...any) error {
+	return &statusError{http.StatusUnprocessableEntity, fmt.Errorf("go.mod:%d: %s", c.Start.Line, fmt.Sprintf(format, args...))}
+}
+
+// parseDirective returns the directive in c, or nil if c isn't one. The
+// directive may follow other text, as in "// indirect; goclone:recursive",
+// which is what go mod tidy makes of it, and text after it that doesn't look
+// like a pattern, such as an explanation, is ignored.
+func parseDirective(c modfile.Comment) (*directive, error) {
+	i := directiveIndex(c.Token)
+	if i < 0 {
+		return nil, nil
+	}
+	f := strings.Fields(c.Token[i:])
+	verb := strings.TrimRight(strings.TrimPrefix(f[0], "goclone:"), ".,;:)")
+	if verb == "" {
+		// Prose like "goclone: see the docs".
+		return nil, nil
+	}
+	if verb != "recursive" && verb != "keep" {
+		return nil, directiveError(c, "unknown directive %q, want goclone:recursive or goclone:keep", f[0])
+	}
+	d := &directive{verb: verb}
+	for _, pat := range f[1:] {
+		if !strings.ContainsAny(pat, "./*") {
+			break
+		}
+		if _, err := path.Match(pat, ""); err != nil {
+			return nil, directiveError(c, "bad pattern %q", pat)
+		}
+		d.patterns = append(d.patterns, pat)
+	}
+	return d, nil
+}
+
+// directiveIndex returns the index in the comment token of the "goclone:"
+// that starts a directive, or -1. The directive must be a whole word at the
+// start of the comment or after a space or ";", so that words and URLs that
+// merely contain "goclone:" are not mistaken for one.
+func directiveIndex(token string) int {
+	start := 0
+	if strings.HasPrefix(token, "//") || strings.HasPrefix(token, "/*") {
+		start = 2
+	}
+	for i := start; ; {
+		j := strings.Index(token[i:], "goclone:")
+		if j < 0 {
+			return -1
+		}
+		i += j
+		if i == start || strings.ContainsRune(" \t;", rune(token[i-1])) {
+			return i
+		}
+		i += len("goclone:")
+	}
+}
+
+// directivesIn parses the directives in the given comments.
+func directivesIn(cs ...[]modfile.Comment) ([]*directive, error) {
+	var ds []*directive
+	for _, list := range cs {
+		for _, c := range list {
+			d, err := parseDirective(c)
+			if err != nil {
+				return nil, err
+			}
+			if d != nil {
+				ds = append(ds, d)
+			}
+		}
+	}
+	return ds, nil
+}
+
+// noDirectives makes sure none of the comments is a directive.
+func noDirectives(where string, cs ...[]modfile.Comment) error {
+	for _, list := range cs {
+		for _, c := range list {
+			d, err := parseDirective(c)
+			if err != nil {
+				return err
+			}
+			if d != nil {
+				return directiveError(c, "goclone:%s is not allowed %s", d.verb, where)
+			}
+		}
+	}
+	return nil
+}
+
+// verbFor returns the verb the directives ds apply to module p, or "".
+func verbFor(ds []*directive, p string) string {
+	verb := ""
+	for _, d := range ds {
+		match := len(d.patterns) == 0
+		for _, pat := range d.patterns {
+			if module.MatchPrefixPatterns(pat, p) {
+				match = true
+			}
+		}
+		if match && verb != "keep" {
+			verb = d.verb
+		}
+	}
+	return verb
+}
+
+// parseDirectives reads the directives in go.mod and resolves them to the
+// requirements they apply to.
+func parseDirectives(modData []byte) (*goModDirectives, error) {
+	f, err := modfile.Parse("go.mod", modData, nil)
+	if err != nil {
+		return nil, err
+	}
+	var modLevel []*directive
+	type req struct {
+		path  string
+		line  []*directive
+		block []*directive
+	}
+	var reqs []req
+
+	required := map[*modfile.Line]string{}
+	for _, r := range f.Require {
+		required[r.Syntax] = r.Mod.Path
+	}
+	requireLine := func(l *modfile.Line, block []*directive) error {
+		var ds []*directive
+		for _, c := range append(l.Comments.Before, l.Comments.Suffix...) {
+			d, err := parseDirective(c)
+			if err != nil {
+				return err
+			}
+			if d == nil {
+				continue
+			}
+			// A require line's directive applies to the line, and
+			// anything after it is commentary.
+			d.patterns = nil
+			if len(ds) > 0 && ds[0].verb != d.verb {
+				return directiveError(c, "conflicting directives on one require line")
+			}
+			ds = append(ds, d)
+		}
+		if p, ok := required[l]; ok {
+			reqs = append(reqs, req{path: p, line: ds, block: block})
+		}
+		return nil
+	}
+
+	for _, stmt := range f.Syntax.Stmt {
+		switch x := stmt.(type) {
+		case *modfile.Line:
+			switch x.Token[0] {
+			case "module":
+				modLevel, err = directivesIn(x.Comments.Before, x.Comments.Suffix)
+			case "require":
+				err = requireLine(x, nil)
+			default:
+				err = noDirectives("on a "+x.Token[0]+" line", x.Comments.Before, x.Comments.Suffix)
+			}
+		case *modfile.LineBlock:
+			if x.Token[0] != "require" {
+				err = noDirectives("on a "+x.Token[0]+" block", x.Comments.Before, x.LParen.Comments.Suffix)
+				for _, l := range x.Line {
+					if err == nil {
+						err = noDirectives("in a "+x.Token[0]+" block", l.Comments.Before, l.Comments.Suffix)
+					}
+				}
+				break
+			}
+			var block []*directive
+			block, err = directivesIn(x.Comments.Before, x.LParen.Comments.Suffix)
+			for _, l := range x.Line {
+				if err == nil {
+					err = requireLine(l, block)
+				}
+			}
+		case *modfile.CommentBlock:
+			err = noDirectives("apart from a module or require line", x.Comments.Before)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dirs := &goModDirectives{}
+	for _, r := range reqs {
+		verb := verbFor(r.line, r.path)
+		if verb == "" {
+			verb = verbFor(r.block, r.path)
+		}
+		if verb == "" {
+			verb = verbFor(modLevel, r.path)
+		}
+		switch verb {
+		case "recursive":
+			dirs.recursive = append(dirs.recursive, r.path)
+		case "keep":
+			dirs.keep = append(dirs.keep, r.path)
+		}
+	}
+	return dirs, nil
+}
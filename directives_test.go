@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDirectives(t *testing.T) {
+	tests := []struct {
+		name      string
+		mod       string
+		recursive []string
+		keep      []string
+	}{
+		{
+			name:      "require line",
+			mod:       "module example.com/a\n\nrequire example.com/b v1.0.0 // goclone:recursive\n\n// goclone:keep\nrequire example.com/c v1.0.0\n",
+			recursive: []string{"example.com/b"},
+			keep:      []string{"example.com/c"},
+		},
+		{
+			name:      "block",
+			mod:       "module example.com/a\n\nrequire ( // goclone:recursive\n\texample.com/b v1.0.0\n\texample.com/c v1.0.0 // goclone:keep\n)\n\nrequire example.com/d v1.0.0\n",
+			recursive: []string{"example.com/b"},
+			keep:      []string{"example.com/c"},
+		},
+		{
+			name:      "module patterns",
+			mod:       "// goclone:recursive example.com/*\n// goclone:keep example.com/c\nmodule example.com/a\n\nrequire (\n\texample.com/b v1.0.0\n\texample.com/c v1.0.0\n\tgolang.org/x/text v0.3.0\n)\n",
+			recursive: []string{"example.com/b"},
+			keep:      []string{"example.com/c"},
+		},
+		{
+			name:      "module all",
+			mod:       "module example.com/a // goclone:recursive\n\nrequire (\n\texample.com/b v1.0.0\n\texample.com/c v1.0.0 //goclone:keep\n)\n",
+			recursive: []string{"example.com/b"},
+			keep:      []string{"example.com/c"},
+		},
+		{
+			name:      "after other text",
+			mod:       "module example.com/a\n\nrequire (\n\texample.com/b v1.0.0 // indirect; goclone:recursive\n\texample.com/c v1.0.0 // goclone:keep example.com/* for now\n)\n",
+			recursive: []string{"example.com/b"},
+			keep:      []string{"example.com/c"},
+		},
+		{
+			name:      "explanations",
+			mod:       "// goclone:recursive example.com/* because their types leak\n// goclone: see the README\nmodule example.com/a\n\nrequire (\n\texample.com/b v1.0.0\n\tgolang.org/x/text v0.3.0\n)\n",
+			recursive: []string{"example.com/b"},
+		},
+		{
+			name: "plain comments",
+			mod:  "// See goclone: docs.\nmodule example.com/a\n\nrequire example.com/b v1.0.0 // indirect\n",
+		},
+		{
+			name:      "words and URLs containing goclone:",
+			mod:       "// see https://goclone:8080/docs\nmodule example.com/a\n\nrequire (\n\texample.com/b v1.0.0 // mygoclone:x\n\texample.com/c v1.0.0 //goclone:recursive\n)\n",
+			recursive: []string{"example.com/c"},
+		},
+	}
+	for _, tt := range tests {
+		dirs, err := parseDirectives([]byte(tt.mod))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(dirs.recursive, tt.recursive) || !reflect.DeepEqual(dirs.keep, tt.keep) {
+			t.Errorf("%s: got recursive %q keep %q, want %q %q", tt.name, dirs.recursive, dirs.keep, tt.recursive, tt.keep)
+		}
+	}
+}
+
+func TestParseDirectivesErrors(t *testing.T) {
+	tests := []struct {
+		mod  string
+		want string
+	}{
+		{"module example.com/a\n\nrequire example.com/b v1.0.0 // goclone:recursiv\n", "go.mod:3: unknown directive"},
+		{"module example.com/a // goclone:keep example.com/[\n", "go.mod:1: bad pattern"},
+		{"module example.com/a\n\n// goclone:keep\nrequire example.com/b v1.0.0 // goclone:recursive\n", "go.mod:4: conflicting directives"},
+		{"module example.com/a\n\nreplace example.com/b => ../b // goclone:keep\n", "go.mod:3: goclone:keep is not allowed on a replace line"},
+		{"module example.com/a\n\n// goclone:recursive\n\nrequire example.com/b v1.0.0\n", "go.mod:3: goclone:recursive is not allowed apart"},
+	}
+	for _, tt := range tests {
+		_, err := parseDirectives([]byte(tt.mod))
+		var se *statusError
+		if !errors.As(err, &se) || se.code != http.StatusUnprocessableEntity || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want 422 %q", tt.mod, err, tt.want)
+		}
+	}
+}
+
+func TestMakeReplacementsKeep(t *testing.T) {
+	defer func(c *config) { conf = c }(conf)
+	conf = &config{Clones: []cloneDef{{Name: "_two", Recursive: "example.com/*"}}}
+	mod := []byte("module example.com/a\n\nrequire (\n\texample.com/a/sub v1.0.0 // goclone:keep\n\texample.com/b v1.0.0\n\texample.com/c v1.0.0 // goclone:keep\n)\n")
+	repl, err := makeReplacements("_two/example.com/a", "example.com/a", mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := rewritePath("example.com/a/sub/pkg", repl); got != "example.com/a/sub/pkg" {
+		t.Errorf("kept nested module rewritten to %s", got)
+	}
+	if got := rewritePath("example.com/c", repl); got != "example.com/c" {
+		t.Errorf("kept dependency rewritten to %s", got)
+	}
+	if got := rewritePath("example.com/b", repl); got != *host+"/_two/example.com/b" {
+		t.Errorf("dependency rewritten to %s", got)
+	}
+}
@@ -83,7 +83,7 @@ func buildModuleB(t *testing.T) (mod, info, zipData []byte) {
 	return
 }
 
-func newRecursiveServer(t *testing.T) *httptest.Server {
+func newRecursiveHandler(t *testing.T) http.Handler {
 	aMod, aInfo, aZip := buildModuleA(t)
 	bMod, bInfo, bZip := buildModuleB(t)
 	mux := http.NewServeMux()
@@ -95,10 +95,10 @@ func newRecursiveServer(t *testing.T) *httptest.Server {
 	mux.HandleFunc("/example.com/b/@v/v1.0.0.mod", func(w http.ResponseWriter, r *http.Request) { w.Write(bMod) })
 	mux.HandleFunc("/example.com/b/@v/v1.0.0.info", func(w http.ResponseWriter, r *http.Request) { w.Write(bInfo) })
 	mux.HandleFunc("/example.com/b/@v/v1.0.0.zip", func(w http.ResponseWriter, r *http.Request) { w.Write(bZip) })
-	return httptest.NewServer(mux)
+	return mux
 }
 
-func newUpstreamServer(t *testing.T) *httptest.Server {
+func newUpstreamHandler(t *testing.T) http.Handler {
 	modV1, infoV1, zipV1 := buildModule(t, "v1.0.0")
 	modV2, infoV2, zipV2 := buildModule(t, "v1.0.1")
 
@@ -124,15 +124,11 @@ func newUpstreamServer(t *testing.T) *httptest.Server {
 	mux.HandleFunc("/example.com/mod/@v/v1.0.1.zip", func(w http.ResponseWriter, r *http.Request) {
 		w.Write(zipV2)
 	})
-	return httptest.NewServer(mux)
+	return mux
 }
 
 func TestEndToEndGoToolchain(t *testing.T) {
-	proxy := newUpstreamServer(t)
-	defer proxy.Close()
-
-	host = stringPtr("goclone.example.com")
-	upstream = stringPtr(proxy.URL)
+	serveUpstream(t, newUpstreamHandler(t))
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/_mod/", proxyHandler)
@@ -194,11 +190,7 @@ func TestEndToEndGoToolchain(t *testing.T) {
 }
 
 func TestRecursiveClone(t *testing.T) {
-	proxy := newRecursiveServer(t)
-	defer proxy.Close()
-
-	host = stringPtr("goclone.example.com")
-	upstream = stringPtr(proxy.URL)
+	serveUpstream(t, newRecursiveHandler(t))
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/_mod/", proxyHandler)
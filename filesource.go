@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// fileSource serves modules from a directory laid out like a module proxy,
+// such as a file:// GOPROXY tree or $GOMODCACHE/cache/download.
+type fileSource struct {
+	url *url.URL
+	dir string
+}
+
+func newFileSource(u *url.URL) (*fileSource, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, errors.New("file upstream must not name a host")
+	}
+	return &fileSource{url: u, dir: filepath.FromSlash(u.Path)}, nil
+}
+
+func (s *fileSource) String() string { return s.url.String() }
+
+func (s *fileSource) fetch(escPath, rest string) (*artifact, error) {
+	// Both come from the request, so make sure they can't name anything
+	// outside the tree.
+	p, err := module.UnescapePath(escPath)
+	if err != nil {
+		return nil, notFound("%v", err)
+	}
+	if strings.ContainsAny(rest, `/\`) || strings.HasPrefix(rest, ".") {
+		return nil, notFound("%s: invalid file %q", p, rest)
+	}
+	vdir := filepath.Join(s.dir, filepath.FromSlash(escPath), "@v")
+	var body []byte
+	switch rest {
+	case "list":
+		body, err = s.list(vdir)
+	case "@latest":
+		body, err = s.latest(vdir)
+	default:
+		body, err = os.ReadFile(filepath.Join(vdir, rest))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return &artifact{status: http.StatusNotFound, header: http.Header{}, body: []byte("not found: " + p + "/@v/" + rest)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &artifact{status: http.StatusOK, header: http.Header{}, body: body}, nil
+}
+
+// list returns the @v/list file in vdir. The module cache only writes one
+// when the go command lists versions, so fall back to listing the versions
+// whose .info files are present.
+func (s *fileSource) list(vdir string) ([]byte, error) {
+	body, err := os.ReadFile(filepath.Join(vdir, "list"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		return body, err
+	}
+	vers, err := fileVersions(vdir)
+	if err != nil {
+		return nil, err
+	}
+	body = []byte{}
+	for _, v := range vers {
+		body = append(body, v+"\n"...)
+	}
+	return body, nil
+}
+
+func fileVersions(vdir string) ([]string, error) {
+	ents, err := os.ReadDir(vdir)
+	if err != nil {
+		return nil, err
+	}
+	var vers []string
+	for _, e := range ents {
+		name, ok := strings.CutSuffix(e.Name(), ".info")
+		if !ok {
+			continue
+		}
+		v, err := module.UnescapeVersion(name)
+		if err != nil || semver.Canonical(v) != v || module.IsPseudoVersion(v) {
+			continue
+		}
+		vers = append(vers, v)
+	}
+	semver.Sort(vers)
+	return vers, nil
+}
+
+// latest synthesizes an @latest response from the highest listed version.
+func (s *fileSource) latest(vdir string) ([]byte, error) {
+	list, err := s.list(vdir)
+	if err != nil {
+		return nil, err
+	}
+	vers := strings.Fields(string(list))
+	if len(vers) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	semver.Sort(vers)
+	v := vers[len(vers)-1]
+	ev, err := module.EscapeVersion(v)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.ReadFile(filepath.Join(vdir, ev+".info")); err == nil {
+		return info, nil
+	}
+	return json.Marshal(struct {
+		Version string
+		Time    time.Time
+	}{Version: v})
+}
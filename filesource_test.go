@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newModCacheDir lays out example.com/mod the way $GOMODCACHE/cache/download
+// does, without a list file.
+func newModCacheDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	vdir := filepath.Join(dir, "example.com", "mod", "@v")
+	if err := os.MkdirAll(vdir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"v1.0.0", "v1.0.1"} {
+		mod, info, zipData := buildModule(t, v)
+		os.WriteFile(filepath.Join(vdir, v+".mod"), mod, 0o644)
+		os.WriteFile(filepath.Join(vdir, v+".info"), info, 0o644)
+		os.WriteFile(filepath.Join(vdir, v+".zip"), zipData, 0o644)
+		os.WriteFile(filepath.Join(vdir, v+".ziphash"), []byte("h1:x"), 0o644)
+	}
+	return dir
+}
+
+func TestFileSource(t *testing.T) {
+	dir := newModCacheDir(t)
+	src, err := parseUpstreamSource("file://"+filepath.ToSlash(dir), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := src.fetch("example.com/mod", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(a.body) != "v1.0.0\nv1.0.1\n" {
+		t.Errorf("unexpected list: %q", a.body)
+	}
+	a, err = src.fetch("example.com/mod", "@latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(a.body), `"v1.0.1"`) {
+		t.Errorf("unexpected latest: %s", a.body)
+	}
+	a, err = src.fetch("example.com/other", "v1.0.0.info")
+	if err != nil || a.status != http.StatusNotFound {
+		t.Errorf("expected 404 for missing module, got %v %v", a, err)
+	}
+	for _, rest := range []string{"../../../etc/passwd", "..", "x/../../list"} {
+		if _, err := src.fetch("example.com/mod", rest); errorStatus(err) != http.StatusNotFound {
+			t.Errorf("%s: expected to be refused, got %v", rest, err)
+		}
+	}
+	if _, err := src.fetch("../../etc", "list"); errorStatus(err) != http.StatusNotFound {
+		t.Errorf("expected bad module path to be refused, got %v", err)
+	}
+	if _, err := newFileSource(&url.URL{Scheme: "file", Host: "server", Path: "/x"}); err == nil {
+		t.Error("expected error for file URL with host")
+	}
+}
+
+func TestProxyHandlerFileUpstream(t *testing.T) {
+	dir := newModCacheDir(t)
+	useUpstream(t, "off|file://"+filepath.ToSlash(dir))
+
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_two/example.com/mod/@v/v1.0.1.mod", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	if !strings.HasPrefix(w.Body.String(), "module goclone.example.com/_two/example.com/mod\n") {
+		t.Errorf("go.mod not rewritten: %s", w.Body)
+	}
+}
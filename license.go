@@ -0,0 +1,348 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"golang.org/x/mod/module"
+)
+
+// Every clone is a modified copy of someone else's code. goclone detects
+// the licenses of the modules it clones, so that a policy can refuse some,
+// and can leave a notice in each zip of what it changed, as licenses like
+// Apache-2.0 require of modified copies.
+
+// licenseReport lists the license files in a module and the licenses
+// detected in them.
+type licenseReport struct {
+	Module  string        `json:"module"`
+	Version string        `json:"version"`
+	Files   []licenseFile `json:"files"`
+	// Licenses are the SPDX identifiers of the licenses detected in the
+	// license files at the root of the module.
+	Licenses []string `json:"licenses"`
+}
+
+type licenseFile struct {
+	Path string `json:"path"`
+	// License is the SPDX identifier of the license detected in the file,
+	// or empty if none was.
+	License string `json:"license,omitempty"`
+	// Package is set on files outside the root whose directory, or one
+	// below it, holds a non-test Go package that binaries may link, as
+	// for vendored third-party code. Licenses of test fixtures and the
+	// like don't cover linked code.
+	Package bool `json:"package,omitempty"`
+}
+
+var licenseReports = &byteCache{max: 256}
+
+// licenseReportFor returns the report for upstreamPath at the escaped
+// version ev, patched with patches. zipData is the patched module zip if the
+// caller already has it.
+func licenseReportFor(upstreamPath, ev string, patches *patchSet, zipData []byte) (*licenseReport, error) {
+	rep := &licenseReport{}
+	err := buildReport(licenseReports, upstreamPath, ev, patches, zipData, rep, func(modPath, v string, zipData, modData []byte) (err error) {
+		rep.Module, rep.Version = modPath, v
+		rep.Files, rep.Licenses, err = scanLicenses(zipData)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// scanLicenses returns the license files in zipData, and the licenses
+// detected at the root.
+func scanLicenses(zipData []byte) ([]licenseFile, []string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, nil, &statusError{http.StatusBadGateway, err}
+	}
+	var pkgDirs []string
+	for _, f := range zr.File {
+		rel, ok := zipRelPath(f.Name)
+		if ok && strings.HasSuffix(rel, ".go") && !strings.HasSuffix(rel, "_test.go") && linkableDir(path.Dir(rel)) {
+			pkgDirs = append(pkgDirs, path.Dir(rel))
+		}
+	}
+	files := []licenseFile{}
+	licenses := []string{}
+	for _, f := range zr.File {
+		rel, ok := zipRelPath(f.Name)
+		if !ok || !isLicenseFile(rel) {
+			continue
+		}
+		b, err := readZipFile(f)
+		if err != nil {
+			return nil, nil, err
+		}
+		lf := licenseFile{Path: rel, License: detectLicense(b)}
+		if dir := path.Dir(rel); dir != "." {
+			lf.Package = slices.ContainsFunc(pkgDirs, func(d string) bool { return d == dir || strings.HasPrefix(d, dir+"/") })
+		}
+		files = append(files, lf)
+		if path.Dir(rel) == "." && lf.License != "" {
+			licenses = append(licenses, lf.License)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	sort.Strings(licenses)
+	return files, slices.Compact(licenses), nil
+}
+
+type licenseType struct {
+	id      string
+	phrases []string
+}
+
+// licenseTypes are the licenses goclone detects, each by phrases that its
+// text contains, in lower case and with punctuation dropped. They are tried
+// in order, since some licenses quote others.
+var licenseTypes = []licenseType{
+	{"AGPL-3.0", []string{"gnu affero general public license version 3"}},
+	{"LGPL-3.0", []string{"gnu lesser general public license version 3"}},
+	{"LGPL-2.1", []string{"gnu lesser general public license version 2.1"}},
+	{"GPL-3.0", []string{"gnu general public license version 3"}},
+	{"GPL-2.0", []string{"gnu general public license version 2"}},
+	{"MPL-2.0", []string{"mozilla public license version 2.0"}},
+	{"Apache-2.0", []string{"apache license version 2.0"}},
+	{"Apache-2.0", []string{"licensed under the apache license version 2.0"}},
+	{"MIT", []string{"permission is hereby granted free of charge to any person obtaining a copy"}},
+	{"BSD-3-Clause", []string{"redistribution and use in source and binary forms", "neither the name"}},
+	{"BSD-2-Clause", []string{"redistribution and use in source and binary forms"}},
+	{"ISC", []string{"permission to use copy modify and or distribute this software for any purpose"}},
+	{"Zlib", []string{"altered source versions must be plainly marked as such"}},
+	{"Unlicense", []string{"this is free and unencumbered software released into the public domain"}},
+	{"CC0-1.0", []string{"cc0 1.0 universal"}},
+}
+
+// detectLicense returns the SPDX identifier of the license in text, or ""
+// if it isn't one that goclone knows.
+func detectLicense(text []byte) string {
+	norm := normalizeLicense(text)
+	for _, lt := range licenseTypes {
+		ok := true
+		for _, p := range lt.phrases {
+			if !strings.Contains(norm, p) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return lt.id
+		}
+	}
+	return ""
+}
+
+// normalizeLicense lowers the case of text and turns runs of anything but
+// letters, digits and dots into single spaces.
+func normalizeLicense(text []byte) string {
+	var b strings.Builder
+	space := true
+	for _, r := range string(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' {
+			b.WriteRune(unicode.ToLower(r))
+			space = false
+		} else if !space {
+			b.WriteByte(' ')
+			space = true
+		}
+	}
+	return b.String()
+}
+
+// licensePolicy refuses to clone modules by their licenses.
+type licensePolicy struct {
+	// Deny lists the SPDX identifiers of licenses whose modules aren't
+	// cloned. It applies to the licenses at the root of the module and to
+	// those covering its Go packages in subdirectories.
+	Deny []string `json:"deny,omitempty"`
+	// DenyUnknown refuses modules with no license goclone detects.
+	DenyUnknown bool `json:"denyUnknown,omitempty"`
+	// Except is a comma-separated list of module path glob patterns,
+	// matched like GOPRIVATE, of modules that may be cloned whatever
+	// their licenses, as after a legal review.
+	Except string `json:"except,omitempty"`
+}
+
+func (p *licensePolicy) check() error {
+	for _, id := range p.Deny {
+		if !slices.ContainsFunc(licenseTypes, func(lt licenseType) bool { return lt.id == id }) {
+			return fmt.Errorf("unknown license %q", id)
+		}
+	}
+	return nil
+}
+
+// allow returns a 403 error if the licenses in rep, the report on the code
+// of module modPath, keep it from being cloned, or nil.
+func (p *licensePolicy) allow(modPath string, rep *licenseReport) error {
+	if p == nil || p.Except != "" && module.MatchPrefixPatterns(p.Except, modPath) {
+		return nil
+	}
+	what := modPath + "@" + rep.Version
+	if len(rep.Licenses) == 0 && p.DenyUnknown {
+		return &statusError{http.StatusForbidden, fmt.Errorf("goclone license policy denies %s: no license detected", what)}
+	}
+	var denied []string
+	for _, f := range rep.Files {
+		if (path.Dir(f.Path) == "." || f.Package) && f.License != "" && slices.Contains(p.Deny, f.License) {
+			denied = append(denied, fmt.Sprintf("%s (%s)", f.License, f.Path))
+		}
+	}
+	if len(denied) > 0 {
+		return &statusError{http.StatusForbidden, fmt.Errorf("goclone license policy denies %s: %s", what, strings.Join(denied, ", "))}
+	}
+	return nil
+}
+
+// noticeFile is the file at the root of a zip listing what goclone
+// changed.
+const noticeFile = "NOTICE.goclone"
+
+// cloneChanges describes what serving module modPath from the clone
+// changes, in sentences for the notice.
+func (d *cloneDef) cloneChanges(clone, modPath, userPath string, patches *patchSet) []string {
+	changes := []string{fmt.Sprintf("The module path was changed from %s to %s, and imports of modules cloned along with it were rewritten to match.", modPath, userPath)}
+	if d == nil {
+		return changes
+	}
+	if s := d.source(modPath); s != nil {
+		changes = append(changes, fmt.Sprintf("The code was taken from %s.", s.Source))
+	}
+	if patches != nil {
+		changes = append(changes, fmt.Sprintf("Patches were applied, as recorded in %s: %s.", patchRecord, patches.names()))
+	}
+	if len(d.Slim) > 0 {
+		changes = append(changes, fmt.Sprintf("Files of these classes were removed: %s.", strings.Join(d.Slim, ", ")))
+	}
+	if d.Namespace {
+		changes = append(changes, fmt.Sprintf("Names registered with database/sql, encoding/gob and expvar were suffixed with %q.", namespaceSuffix(clone)))
+	}
+	if d.CgoPrefix {
+		changes = append(changes, fmt.Sprintf("C symbols were prefixed with %q.", cgoPrefix(clone)))
+	}
+	if d.RenamePackages {
+		changes = append(changes, fmt.Sprintf("Package names were suffixed with %q.", packageSuffix(clone)))
+	}
+	return changes
+}
+
+// noticeZip returns data, the zip goclone made of the module modPath at
+// version v from orig, with a notice of the changes added as noticeFile and
+// a comment at the top of each Go file changed.
+func noticeZip(orig, data []byte, modPath, v string, changes []string) ([]byte, error) {
+	or, err := zip.NewReader(bytes.NewReader(orig), int64(len(orig)))
+	if err != nil {
+		return nil, &statusError{http.StatusBadGateway, err}
+	}
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	origFiles := map[string]*zip.File{}
+	for _, f := range or.File {
+		if rel, ok := zipRelPath(f.Name); ok {
+			origFiles[rel] = f
+		}
+	}
+
+	root := ""
+	var modified, added []string
+	contents := map[string][]byte{}
+	for _, f := range r.File {
+		rel, ok := zipRelPath(f.Name)
+		if !ok {
+			continue
+		}
+		root = strings.TrimSuffix(f.Name, rel)
+		b, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		of := origFiles[rel]
+		delete(origFiles, rel)
+		if of == nil {
+			added = append(added, rel)
+		} else {
+			ob, err := readZipFile(of)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.Equal(b, ob) {
+				continue
+			}
+			modified = append(modified, rel)
+		}
+		if strings.HasSuffix(rel, ".go") {
+			contents[rel] = append([]byte(fmt.Sprintf("// This file was modified by goclone; see %s.\n\n", noticeFile)), b...)
+		}
+	}
+	var removed []string
+	for rel := range origFiles {
+		removed = append(removed, rel)
+	}
+	sort.Strings(modified)
+	sort.Strings(added)
+	sort.Strings(removed)
+
+	var notice bytes.Buffer
+	fmt.Fprintf(&notice, "This module is a copy of %s@%s, modified by goclone.\n\n", modPath, v)
+	for _, c := range changes {
+		fmt.Fprintf(&notice, "%s\n", c)
+	}
+	for _, list := range []struct {
+		title string
+		files []string
+	}{{"Modified files", modified}, {"Added files", added}, {"Removed files", removed}} {
+		if len(list.files) == 0 {
+			continue
+		}
+		fmt.Fprintf(&notice, "\n%s:\n", list.title)
+		for _, rel := range list.files {
+			fmt.Fprintf(&notice, "\t%s\n", rel)
+		}
+	}
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, f := range r.File {
+		rel, _ := zipRelPath(f.Name)
+		if b, ok := contents[rel]; ok {
+			fw, err := w.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate})
+			if err == nil {
+				_, err = fw.Write(b)
+			}
+			if err != nil {
+				return nil, err
+			}
+		} else if err := copyZipFile(w, f, f.Name); err != nil {
+			return nil, err
+		}
+	}
+	if root == "" {
+		return nil, errors.New("empty module zip")
+	}
+	fw, err := w.CreateHeader(&zip.FileHeader{Name: root + noticeFile, Method: zip.Deflate})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(notice.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	mitText = `MIT License
+
+Copyright (c) 2024 Someone
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction.
+`
+	bsd3Text = `Copyright 2009 The Go Authors.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Neither the name of Google LLC nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+`
+	gpl3Text = `                    GNU GENERAL PUBLIC LICENSE
+                       Version 3, 29 June 2007
+
+ Copyright (C) 2007 Free Software Foundation, Inc. <https://fsf.org/>
+`
+	apacheText = `
+                                 Apache License
+                           Version 2.0, January 2004
+                        http://www.apache.org/licenses/
+`
+)
+
+func TestDetectLicense(t *testing.T) {
+	for text, want := range map[string]string{
+		mitText:    "MIT",
+		bsd3Text:   "BSD-3-Clause",
+		gpl3Text:   "GPL-3.0",
+		apacheText: "Apache-2.0",
+		"                   GNU LESSER GENERAL PUBLIC LICENSE\n                       Version 3, 29 June 2007\n": "LGPL-3.0",
+		"Redistribution and use in source and binary forms, with or without\nmodification, are permitted.\n":     "BSD-2-Clause",
+		"All rights reserved.\n": "",
+	} {
+		if got := detectLicense([]byte(text)); got != want {
+			t.Errorf("detectLicense(%.40q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestLicensePolicy(t *testing.T) {
+	rep := &licenseReport{
+		Module:   "example.com/m",
+		Version:  "v1.0.0",
+		Files:    []licenseFile{{Path: "LICENSE", License: "MIT"}, {Path: "third_party/x/COPYING", License: "GPL-3.0", Package: true}},
+		Licenses: []string{"MIT"},
+	}
+	fixture := &licenseReport{
+		Module:   "example.com/m",
+		Version:  "v1.0.0",
+		Files:    []licenseFile{{Path: "LICENSE", License: "MIT"}, {Path: "testdata/x/COPYING", License: "GPL-3.0"}},
+		Licenses: []string{"MIT"},
+	}
+	unknown := &licenseReport{Module: "example.com/m", Version: "v1.0.0", Files: []licenseFile{{Path: "LICENSE"}}}
+	tests := []struct {
+		p    *licensePolicy
+		rep  *licenseReport
+		want string
+	}{
+		{nil, unknown, ""},
+		{&licensePolicy{Deny: []string{"AGPL-3.0"}}, rep, ""},
+		{&licensePolicy{Deny: []string{"GPL-3.0"}}, rep, "goclone license policy denies example.com/m@v1.0.0: GPL-3.0 (third_party/x/COPYING)"},
+		{&licensePolicy{Deny: []string{"GPL-3.0"}, Except: "example.com/*"}, rep, ""},
+		{&licensePolicy{Deny: []string{"GPL-3.0"}}, fixture, ""},
+		{&licensePolicy{Deny: []string{"MIT"}}, fixture, "goclone license policy denies example.com/m@v1.0.0: MIT (LICENSE)"},
+		{&licensePolicy{DenyUnknown: true}, rep, ""},
+		{&licensePolicy{DenyUnknown: true}, unknown, "goclone license policy denies example.com/m@v1.0.0: no license detected"},
+	}
+	for i, tt := range tests {
+		err := tt.p.allow("example.com/m", tt.rep)
+		if got := fmt.Sprint(err); tt.want == "" && err != nil || tt.want != "" && got != tt.want {
+			t.Errorf("%d: got %v, want %q", i, err, tt.want)
+		}
+		if err != nil && errorStatus(err) != http.StatusForbidden {
+			t.Errorf("%d: status %d, want 403", i, errorStatus(err))
+		}
+	}
+	if err := (&licensePolicy{Deny: []string{"GPL-3"}}).check(); err == nil {
+		t.Errorf("unknown license accepted")
+	}
+}
+
+func TestScanLicenses(t *testing.T) {
+	zipData := buildZip(t, "example.com/m@v1.0.0/", map[string]string{
+		"go.mod":                   "module example.com/m\n",
+		"LICENSE":                  mitText,
+		"m.go":                     "package m\n",
+		"third_party/x/COPYING":    gpl3Text,
+		"third_party/x/inner/x.go": "package inner\n",
+		"testdata/fixture/COPYING": gpl3Text,
+		"testdata/fixture/f.go":    "package fixture\n",
+		"tools/LICENSE":            apacheText,
+		"tools/tools_test.go":      "package tools\n",
+		"docs/LICENSE":             bsd3Text,
+	})
+	files, licenses, err := scanLicenses(zipData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[{LICENSE MIT false} {docs/LICENSE BSD-3-Clause false} {testdata/fixture/COPYING GPL-3.0 false} {third_party/x/COPYING GPL-3.0 true} {tools/LICENSE Apache-2.0 false}]"
+	if got := fmt.Sprint(files); got != want {
+		t.Errorf("files = %s, want %s", got, want)
+	}
+	if fmt.Sprint(licenses) != "[MIT]" {
+		t.Errorf("licenses = %v", licenses)
+	}
+}
+
+func TestNoticeZip(t *testing.T) {
+	orig := buildZip(t, "example.com/m@v1.0.0/", map[string]string{
+		"go.mod":    "module example.com/m\n",
+		"LICENSE":   mitText,
+		"a.go":      "package m\n\nimport _ \"example.com/m/sub\"\n",
+		"b.go":      "package m\n",
+		"a_test.go": "package m\n",
+	})
+	data := buildZip(t, "goclone.example.com/_two/example.com/m@v1.0.0/", map[string]string{
+		"go.mod":    "module goclone.example.com/_two/example.com/m\n",
+		"LICENSE":   mitText,
+		"a.go":      "package m\n\nimport _ \"goclone.example.com/_two/example.com/m/sub\"\n",
+		"b.go":      "package m\n",
+		patchRecord: "# fix\n",
+	})
+	out, err := noticeZip(orig, data, "example.com/m", "v1.0.0", []string{"Something changed."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, f := range zr.File {
+		b, _ := readZipFile(f)
+		got[strings.TrimPrefix(f.Name, "goclone.example.com/_two/example.com/m@v1.0.0/")] = string(b)
+	}
+	wantNotice := `This module is a copy of example.com/m@v1.0.0, modified by goclone.
+
+Something changed.
+
+Modified files:
+	a.go
+	go.mod
+
+Added files:
+	goclone.patches
+
+Removed files:
+	a_test.go
+`
+	if got[noticeFile] != wantNotice {
+		t.Errorf("notice:\n%s\nwant:\n%s", got[noticeFile], wantNotice)
+	}
+	if !strings.HasPrefix(got["a.go"], "// This file was modified by goclone; see NOTICE.goclone.\n\npackage m\n") {
+		t.Errorf("a.go:\n%s", got["a.go"])
+	}
+	if got["b.go"] != "package m\n" || got["go.mod"] != "module goclone.example.com/_two/example.com/m\n" {
+		t.Errorf("unchanged files were changed: %q %q", got["b.go"], got["go.mod"])
+	}
+}
+
+func TestProxyHandlerLicense(t *testing.T) {
+	zips := map[string][]byte{
+		"mit": buildZip(t, "example.com/lic/mit@v1.0.0/", map[string]string{
+			"go.mod":  "module example.com/lic/mit\n",
+			"LICENSE": mitText,
+			"a.go":    "package mit\n\nimport \"example.com/lic/mit/sub\"\n\nvar _ = sub.X\n",
+		}),
+		"gpl": buildZip(t, "example.com/lic/gpl@v1.0.0/", map[string]string{
+			"go.mod":  "module example.com/lic/gpl\n",
+			"COPYING": gpl3Text,
+			"a.go":    "package gpl\n",
+		}),
+		"none": buildZip(t, "example.com/lic/none@v1.0.0/", map[string]string{
+			"go.mod": "module example.com/lic/none\n",
+			"a.go":   "package none\n",
+		}),
+	}
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/example.com/lic/"), "/")
+		switch {
+		case zips[name] == nil:
+			http.NotFound(w, r)
+		case rest == "@v/v1.0.0.mod":
+			fmt.Fprintf(w, "module example.com/lic/%s\n", name)
+		case rest == "@v/v1.0.0.zip":
+			w.Write(zips[name])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	conf = &config{Clones: []cloneDef{{Name: "_notice", Notice: true}}}
+	defer func(p *policy) { pol = p }(pol)
+	pol = &policy{Licenses: &licensePolicy{Deny: []string{"GPL-3.0"}, DenyUnknown: true}}
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", url, nil)
+		if strings.HasPrefix(url, "/_report/") {
+			reportHandler(w, r)
+		} else {
+			proxyHandler(w, r)
+		}
+		return w
+	}
+	w := get("/_mod/goclone.example.com/_notice/example.com/lic/mit/@v/v1.0.0.zip")
+	if w.Code != http.StatusOK {
+		t.Fatalf("mit: %d %s", w.Code, w.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var notice string
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, "/"+noticeFile) {
+			b, _ := readZipFile(f)
+			notice = string(b)
+		}
+	}
+	if !strings.Contains(notice, "The module path was changed from example.com/lic/mit to goclone.example.com/_notice/example.com/lic/mit") || !strings.Contains(notice, "\ta.go\n") {
+		t.Errorf("notice:\n%s", notice)
+	}
+
+	for _, name := range []string{"gpl", "none"} {
+		w := get("/_mod/goclone.example.com/_notice/example.com/lic/" + name + "/@v/v1.0.0.zip")
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "license policy") {
+			t.Errorf("%s: %d %s", name, w.Code, w.Body)
+		}
+	}
+
+	w = get("/_report/license/goclone.example.com/_notice/example.com/lic/gpl@v1.0.0")
+	var rep licenseReport
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("report: %d %s", w.Code, w.Body)
+	}
+	if fmt.Sprint(rep.Licenses) != "[GPL-3.0]" || len(rep.Files) != 1 || rep.Files[0].Path != "COPYING" {
+		t.Errorf("report: %+v", rep)
+	}
+}
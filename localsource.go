@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// localSource serves a single module from a working directory on disk, so a
+// locally modified dependency can be cloned without publishing it. It serves
+// one version, either a configured tag or a fixed pseudo-version. The go
+// command caches modules by version, so after changing the source, clear
+// the clone out of the module cache or configure a new version.
+type localSource struct {
+	path    string
+	dir     string
+	version string
+}
+
+// newLocalSource parses a -local-module value of the form dir[@version].
+func newLocalSource(p, spec string) (*localSource, error) {
+	s := &localSource{path: p, dir: spec}
+	if i := strings.LastIndex(spec, "@"); i >= 0 && semver.IsValid(spec[i+1:]) {
+		s.dir, s.version = spec[:i], spec[i+1:]
+		if semver.Canonical(s.version) != s.version {
+			return nil, fmt.Errorf("%s: version %s is not canonical", p, s.version)
+		}
+	} else {
+		_, pathMajor, _ := module.SplitPathVersion(p)
+		major := strings.TrimLeft(pathMajor, "/.")
+		s.version = module.PseudoVersion(major, "", time.Time{}, "000000000000")
+	}
+	if err := module.Check(p, s.version); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *localSource) String() string { return "local" }
+
+func (s *localSource) fetch(escPath, rest string) (*artifact, error) {
+	var body []byte
+	var err error
+	switch rest {
+	case "list":
+		body = []byte(s.version + "\n")
+	case "@latest", s.version + ".info":
+		body, err = json.Marshal(struct {
+			Version string
+			Time    time.Time
+		}{Version: s.version})
+	case s.version + ".mod":
+		body, err = os.ReadFile(filepath.Join(s.dir, "go.mod"))
+		if errors.Is(err, fs.ErrNotExist) {
+			body, err = []byte(fmt.Sprintf("module %s\n", s.path)), nil
+		}
+	case s.version + ".zip":
+		var buf bytes.Buffer
+		err = modzip.CreateFromDir(&buf, module.Version{Path: s.path, Version: s.version}, s.dir)
+		body = buf.Bytes()
+	default:
+		return nil, notFound("%s: local module only has version %s", s.path, s.version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set("X-Goclone-Upstream", s.String())
+	return &artifact{status: http.StatusOK, header: header, body: body}, nil
+}
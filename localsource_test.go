@@ -0,0 +1,82 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newLocalModuleDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "pkg"), 0o755)
+	os.MkdirAll(filepath.Join(dir, "use"), 0o755)
+	os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/local\n\ngo 1.20\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "pkg", "pkg.go"), []byte("package pkg\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "use", "use.go"), []byte("package use\n\nimport _ \"example.com/local/pkg\"\n"), 0o644)
+	return dir
+}
+
+func TestNewLocalSource(t *testing.T) {
+	s, err := newLocalSource("example.com/local", "/src/local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.dir != "/src/local" || s.version != "v0.0.0-00010101000000-000000000000" {
+		t.Errorf("unexpected source %+v", s)
+	}
+	s, err = newLocalSource("example.com/local/v2", "/src/local@v2.1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.dir != "/src/local" || s.version != "v2.1.0" {
+		t.Errorf("unexpected source %+v", s)
+	}
+	if _, err := newLocalSource("example.com/local", "/src/local@v2.1.0"); err == nil {
+		t.Error("expected error for version not matching the module path")
+	}
+}
+
+func TestProxyHandlerLocalModule(t *testing.T) {
+	dir := newLocalModuleDir(t)
+	localModules["example.com/local"] = dir + "@v1.2.3"
+	defer delete(localModules, "example.com/local")
+	useUpstream(t, "off")
+
+	get := func(rest string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_dev/example.com/local/@v/"+rest, nil))
+		return w
+	}
+	if w := get("list"); w.Body.String() != "v1.2.3\n" {
+		t.Errorf("unexpected list: %q", w.Body)
+	}
+	if w := get("v1.0.0.info"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for other versions, got %d", w.Code)
+	}
+	w := get("v1.2.3.zip")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	data := w.Body.Bytes()
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		if !strings.HasPrefix(f.Name, "goclone.example.com/_dev/example.com/local@v1.2.3/") {
+			t.Errorf("file name not rewritten: %s", f.Name)
+		}
+		if strings.HasSuffix(f.Name, "use/use.go") {
+			b, _ := readZipFile(f)
+			if !bytes.Contains(b, []byte("goclone.example.com/_dev/example.com/local/pkg")) {
+				t.Errorf("import not rewritten: %s", b)
+			}
+		}
+	}
+}
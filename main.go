@@ -5,8 +5,10 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"go/ast"
 	"go/format"
 	"go/parser"
 	"go/token"
@@ -16,24 +18,109 @@ import (
 	"net/http/httptest"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
 )
 
 var (
-	addr     = flag.String("addr", ":8080", "listen address")
-	host     = flag.String("host", "goclone.zone", "public host for vanity imports")
-	upstream = flag.String("upstream", "https://proxy.golang.org", "upstream module proxy")
+	addr      = flag.String("addr", ":8080", "listen address")
+	host      = flag.String("host", "goclone.zone", "public host for vanity imports")
+	upstream  = flag.String("upstream", "https://proxy.golang.org", "upstream module proxies, in GOPROXY list syntax")
+	workers   = flag.Int("rewrite-workers", runtime.GOMAXPROCS(0), "number of zip entries to rewrite concurrently")
+	confFile  = flag.String("config", "", "JSON configuration file")
+	polFile   = flag.String("policy", "", "JSON file of rules for which modules may be cloned")
+	vcsCache  = flag.String("vcs-cache", filepath.Join(os.TempDir(), "goclone-vcs"), "directory for git repositories fetched by the \"direct\" upstream")
+	directSSH = flag.Bool("direct-ssh", false, "let the \"direct\" upstream fetch ssh:// repositories found through go-import tags, not only https:// ones")
+
+	directRepos  = pathMap{}
+	localModules = pathMap{}
 )
 
+func init() {
+	flag.Var(directRepos, "direct-repo", "`prefix=url` pairs mapping module paths to git repositories for the \"direct\" upstream")
+	flag.Var(localModules, "local-module", "`path=dir[@version]` pairs serving module path from a local directory")
+}
+
+// pathMap is a flag that maps module path prefixes to values. It may be given
+// more than once, and each value may hold several comma-separated
+// prefix=value pairs.
+type pathMap map[string]string
+
+func (m pathMap) String() string {
+	var pairs []string
+	for k, v := range m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m pathMap) Set(s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" || v == "" {
+			return fmt.Errorf("invalid pair %q, want prefix=value", pair)
+		}
+		m[k] = v
+	}
+	return nil
+}
+
+// lookup returns the value for the longest prefix of p in m.
+func (m pathMap) lookup(p string) (prefix, value string, ok bool) {
+	for k, v := range m {
+		if (p == k || strings.HasPrefix(p, k+"/")) && len(k) > len(prefix) {
+			prefix, value, ok = k, v, true
+		}
+	}
+	return prefix, value, ok
+}
+
+// flagsFromEnv sets any flag not given on the command line from a
+// GOCLONE_<NAME> environment variable, e.g. GOCLONE_REWRITE_WORKERS. This is
+// how the Lambda deployment, which has no command line, is configured.
+func flagsFromEnv() error {
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] || err != nil {
+			return
+		}
+		env := "GOCLONE_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if v, ok := os.LookupEnv(env); ok {
+			if e := f.Value.Set(v); e != nil {
+				err = fmt.Errorf("%s: %v", env, e)
+			}
+		}
+	})
+	return err
+}
+
 func vanityHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Query().Get("go-get") != "1" {
 		http.NotFound(w, r)
 		return
 	}
 	mod := strings.TrimPrefix(r.URL.Path, "/")
+	if err := authorize(r, mod); err != nil {
+		writeError(w, err)
+		return
+	}
+	clone, p := splitClonePath(mod)
+	if err := pol.allow(clone, p, ""); err != nil {
+		writeError(w, err)
+		return
+	}
 	html := fmt.Sprintf("<meta name=\"go-import\" content=\"%s/%s mod https://%s/_mod/\">", *host, mod, *host)
 	fmt.Fprint(w, html)
 }
@@ -84,13 +171,55 @@ func rewriteFileName(name string, repl map[string]string) string {
 	return strings.Replace(name, best, repl[best], 1)
 }
 
+// transform is an edit to the files of a zip, made along with the path
+// rewriting. Transforms are goTransforms, srcTransforms, or both.
+type transform interface {
+	// mayApply reports whether the transform may change src. Files that no
+	// transform may change and that mention no rewritten path are copied
+	// unchanged.
+	mayApply(src []byte) bool
+}
+
+// goTransform edits parsed Go files.
+type goTransform interface {
+	transform
+	// apply edits f, from the zip entry name, and reports whether it changed
+	// anything.
+	apply(name string, fset *token.FileSet, f *ast.File) bool
+}
+
+// srcTransform edits the source of any file but go.mod, before any other
+// rewriting.
+type srcTransform interface {
+	transform
+	applySrc(name string, src []byte) ([]byte, error)
+}
+
+// modTransform edits parsed go.mod files, after their paths are rewritten.
+type modTransform interface {
+	transform
+	// applyMod edits f and reports whether it changed anything.
+	applyMod(f *modfile.File) (bool, error)
+}
+
 func rewriteGoImports(src []byte, repl map[string]string) ([]byte, error) {
+	return rewriteGoFile("", src, repl, nil)
+}
+
+// rewriteGoFile rewrites the imports of the Go file name and applies the
+// transforms to it.
+func rewriteGoFile(name string, src []byte, repl map[string]string, xforms []transform) ([]byte, error) {
 	fset := token.NewFileSet()
-	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	f, err := parser.ParseFile(fset, name, src, parser.ParseComments)
 	if err != nil {
 		return nil, err
 	}
 	changed := false
+	for _, x := range xforms {
+		if x, ok := x.(goTransform); ok && x.mayApply(src) && x.apply(name, fset, f) {
+			changed = true
+		}
+	}
 	for _, imp := range f.Imports {
 		path, err := strconv.Unquote(imp.Path.Value)
 		if err != nil {
@@ -112,25 +241,6 @@ func rewriteGoImports(src []byte, repl map[string]string) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// recursiveDeps returns the paths of required modules that have the
-// "goclone:recursive" comment.
-func recursiveDeps(modData []byte) ([]string, error) {
-	f, err := modfile.Parse("go.mod", modData, nil)
-	if err != nil {
-		return nil, err
-	}
-	var deps []string
-	for _, r := range f.Require {
-		for _, c := range r.Syntax.Suffix {
-			if strings.Contains(c.Token, "goclone:recursive") {
-				deps = append(deps, r.Mod.Path)
-				break
-			}
-		}
-	}
-	return deps, nil
-}
-
 func extractGoModFromZip(data []byte) ([]byte, error) {
 	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
 	if err != nil {
@@ -153,19 +263,35 @@ func extractGoModFromZip(data []byte) ([]byte, error) {
 	return nil, fmt.Errorf("go.mod not found")
 }
 
-func makeReplacements(userPath, upstreamPath string, modData []byte) (map[string]string, error) {
+func makeReplacements(userPath, upstreamPath string, modData []byte, extra ...string) (map[string]string, error) {
 	repl := map[string]string{
 		upstreamPath: fmt.Sprintf("%s/%s", *host, userPath),
 	}
-	deps, err := recursiveDeps(modData)
+	prefix, _ := splitClonePath(userPath)
+	var def *cloneDef
+	if modPath, err := unescapeModPath(upstreamPath); err == nil {
+		def = cloneDefFor(prefix, modPath)
+		// A source, like a fork, may refer to itself by its own path.
+		if s := def.source(modPath); s != nil {
+			repl[s.Source] = repl[upstreamPath]
+		}
+	}
+	deps, err := def.familyDeps(modData)
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := parseDirectives(modData)
 	if err != nil {
 		return nil, err
 	}
-	prefix := ""
-	if strings.HasPrefix(userPath, "_") {
-		segs := strings.SplitN(userPath, "/", 2)
-		if len(segs) == 2 {
-			prefix = segs[0]
+	// Kept dependencies map to themselves, so that they stay put even
+	// under a path that is rewritten, like a nested module of the clone.
+	for _, d := range dirs.keep {
+		repl[d] = d
+	}
+	for _, d := range extra {
+		if !slices.Contains(dirs.keep, d) {
+			deps = append(deps, d)
 		}
 	}
 	for _, d := range deps {
@@ -179,6 +305,12 @@ func makeReplacements(userPath, upstreamPath string, modData []byte) (map[string
 }
 
 func rewriteGoMod(src []byte, repl map[string]string) ([]byte, error) {
+	return rewriteModFile(src, repl, nil)
+}
+
+// rewriteModFile rewrites the paths in the go.mod file src and applies the
+// transforms to it.
+func rewriteModFile(src []byte, repl map[string]string, xforms []transform) ([]byte, error) {
 	f, err := modfile.Parse("go.mod", src, nil)
 	if err != nil {
 		return nil, err
@@ -215,6 +347,15 @@ func rewriteGoMod(src []byte, repl map[string]string) ([]byte, error) {
 			changed = true
 		}
 	}
+	for _, x := range xforms {
+		if x, ok := x.(modTransform); ok && x.mayApply(src) {
+			c, err := x.applyMod(f)
+			if err != nil {
+				return nil, err
+			}
+			changed = changed || c
+		}
+	}
 	if !changed {
 		return src, nil
 	}
@@ -225,40 +366,143 @@ func rewriteGoMod(src []byte, repl map[string]string) ([]byte, error) {
 	return b, nil
 }
 
-func rewriteZip(data []byte, repl map[string]string) ([]byte, error) {
-	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+// mayContainPath reports whether src could import any of the paths being
+// replaced. Import paths are string literals, so a file that does not contain
+// any of the old paths verbatim can't need rewriting and isn't worth parsing.
+func mayContainPath(src []byte, repl map[string]string) bool {
+	for old := range repl {
+		if bytes.Contains(src, []byte(old)) {
+			return true
+		}
+	}
+	return false
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
 	if err != nil {
 		return nil, err
 	}
-	var buf bytes.Buffer
-	w := zip.NewWriter(&buf)
-	for _, f := range r.File {
-		rc, err := f.Open()
-		if err != nil {
-			return nil, err
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// copyZipFile copies f into w under name without decompressing and
+// recompressing its contents.
+func copyZipFile(w *zip.Writer, f *zip.File, name string) error {
+	rc, err := f.OpenRaw()
+	if err != nil {
+		return err
+	}
+	hdr := f.FileHeader
+	hdr.Name = name
+	fw, err := w.CreateRaw(&hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, rc)
+	return err
+}
+
+// rewriteZipFile returns the rewritten contents of f, or nil if f can be
+// copied through unchanged.
+func rewriteZipFile(f *zip.File, repl map[string]string, xforms []transform) ([]byte, error) {
+	var rewrite func([]byte, map[string]string) ([]byte, error)
+	if strings.HasSuffix(f.Name, ".go") {
+		rewrite = func(src []byte, repl map[string]string) ([]byte, error) {
+			return rewriteGoFile(f.Name, src, repl, xforms)
 		}
-		b, err := io.ReadAll(rc)
-		rc.Close()
-		if err != nil {
-			return nil, err
+	} else if path.Base(f.Name) == "go.mod" {
+		// Only modTransforms apply to go.mod.
+		xforms = slices.DeleteFunc(slices.Clone(xforms), func(x transform) bool { _, ok := x.(modTransform); return !ok })
+		rewrite = func(src []byte, repl map[string]string) ([]byte, error) {
+			return rewriteModFile(src, repl, xforms)
 		}
-		if strings.HasSuffix(f.Name, ".go") {
-			b, err = rewriteGoImports(b, repl)
-			if err != nil {
+	} else if slices.ContainsFunc(xforms, func(x transform) bool { _, ok := x.(srcTransform); return ok }) {
+		rewrite = func(src []byte, repl map[string]string) ([]byte, error) { return src, nil }
+		repl = nil
+	} else {
+		return nil, nil
+	}
+	b, err := readZipFile(f)
+	if err != nil {
+		return nil, err
+	}
+	if !mayContainPath(b, repl) && !slices.ContainsFunc(xforms, func(x transform) bool { return x.mayApply(b) }) {
+		return nil, nil
+	}
+	src := b
+	for _, x := range xforms {
+		if x, ok := x.(srcTransform); ok && x.mayApply(src) {
+			if src, err = x.applySrc(f.Name, src); err != nil {
 				return nil, err
 			}
-		} else if path.Base(f.Name) == "go.mod" {
-			b, err = rewriteGoMod(b, repl)
-			if err != nil {
-				return nil, err
+		}
+	}
+	nb, err := rewrite(src, repl)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(nb, b) {
+		return nil, nil
+	}
+	return nb, nil
+}
+
+// rewriteZipFiles runs rewriteZipFile over files using up to n goroutines.
+// The results are in the same order as files.
+func rewriteZipFiles(files []*zip.File, repl map[string]string, n int, xforms []transform) ([][]byte, error) {
+	if n < 1 {
+		n = 1
+	}
+	out := make([][]byte, len(files))
+	errs := make([]error, len(files))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(n, len(files)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				out[i], errs[i] = rewriteZipFile(files[i], repl, xforms)
 			}
+		}()
+	}
+	for i := range files {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", files[i].Name, err)
 		}
-		newName := rewriteFileName(f.Name, repl)
-		if newName != f.Name {
-			f.Name = newName
+	}
+	return out, nil
+}
+
+func rewriteZip(data []byte, repl map[string]string, xforms ...transform) ([]byte, error) {
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	contents, err := rewriteZipFiles(r.File, repl, *workers, xforms)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for i, f := range r.File {
+		b := contents[i]
+		name := rewriteFileName(f.Name, repl)
+		if b == nil {
+			if err := copyZipFile(w, f, name); err != nil {
+				return nil, err
+			}
+			continue
 		}
 		hdr := &zip.FileHeader{
-			Name:   f.Name,
+			Name:   name,
 			Method: f.Method,
 		}
 		if fw, err := w.CreateHeader(hdr); err == nil {
@@ -278,7 +522,10 @@ func rewriteZip(data []byte, repl map[string]string) ([]byte, error) {
 func parseProxyPath(p string) (userPath, upstreamPath, rest string, ok bool) {
 	parts := strings.SplitN(p, "/@v/", 2)
 	if len(parts) != 2 {
-		return "", "", "", false
+		if !strings.HasSuffix(p, "/@latest") {
+			return "", "", "", false
+		}
+		parts = []string{strings.TrimSuffix(p, "/@latest"), "@latest"}
 	}
 	userPath = parts[0]
 	rest = parts[1]
@@ -293,72 +540,373 @@ func parseProxyPath(p string) (userPath, upstreamPath, rest string, ok bool) {
 	return userPath, upstreamPath, rest, true
 }
 
-func proxyHandler(w http.ResponseWriter, r *http.Request) {
-	trimmed := strings.TrimPrefix(r.URL.Path, "/_mod/")
-	trimmed = strings.TrimPrefix(trimmed, *host+"/")
-	userPath, upstreamPath, rest, ok := parseProxyPath(trimmed)
-	if !ok {
-		http.NotFound(w, r)
-		return
+// statusError is an error that should be reported to the client with a
+// particular HTTP status code.
+type statusError struct {
+	code int
+	err  error
+}
+
+func (e *statusError) Error() string { return e.err.Error() }
+func (e *statusError) Unwrap() error { return e.err }
+
+// errorStatus returns the HTTP status code to report err with.
+func errorStatus(err error) int {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code
 	}
-	upstreamURL := fmt.Sprintf("%s/%s/@v/%s", *upstream, upstreamPath, rest)
-	resp, err := http.Get(upstreamURL)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
-		return
+	return http.StatusInternalServerError
+}
+
+// artifact is a response body along with the status and headers it should
+// be served with.
+type artifact struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// flightGroup collapses concurrent calls with the same key into one call
+// whose result is shared by all callers.
+type flightGroup[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*flight[T]
+}
+
+type flight[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+}
+
+func (g *flightGroup[T]) do(key string, fn func() (T, error)) (T, error) {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.val, c.err
+	}
+	if g.calls == nil {
+		g.calls = map[string]*flight[T]{}
 	}
-	defer resp.Body.Close()
+	c := &flight[T]{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
 
-	for k, v := range resp.Header {
-		w.Header()[k] = v
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+	}()
+	c.val, c.err = fn()
+	return c.val, c.err
+}
+
+// byteCache is a small cache that forgets the oldest entries once it holds
+// more than max of them.
+type byteCache struct {
+	mu   sync.Mutex
+	max  int
+	m    map[string][]byte
+	keys []string
+}
+
+func (c *byteCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.m[key]
+	return b, ok
+}
+
+func (c *byteCache) put(key string, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = map[string][]byte{}
+	}
+	if _, ok := c.m[key]; !ok {
+		c.keys = append(c.keys, key)
+	}
+	c.m[key] = b
+	for len(c.keys) > c.max {
+		delete(c.m, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+}
+
+var (
+	upstreamFlights flightGroup[*artifact]
+	artifactFlights flightGroup[*artifact]
+	// upstreamMods holds recently fetched go.mod files, keyed by
+	// module@version, so a .zip request can reuse the .mod fetched just
+	// before it.
+	upstreamMods = &byteCache{max: 256}
+)
+
+// buildArtifact fetches rest for upstreamPath and rewrites it to be served as
+// userPath.
+func buildArtifact(userPath, upstreamPath, rest string) (*artifact, error) {
+	clone, _ := splitClonePath(userPath)
+	modPath, err := unescapeModPath(upstreamPath)
+	if err != nil {
+		return nil, notFound("%v", err)
 	}
-	// Go's HTTP client automatically decompresses gzip responses. If the
-	// upstream sent a gzip encoded body, resp.Body will already be
-	// decompressed but the Content-Encoding header will still be present.
-	// Strip it to avoid telling the client the body is gzip when it isn't.
-	w.Header().Del("Content-Encoding")
-	if strings.HasSuffix(trimmed, ".zip") || strings.HasSuffix(trimmed, ".mod") {
-		data, err := io.ReadAll(resp.Body)
+	def := cloneDefFor(clone, modPath)
+	check := func(v string) error {
+		if err := def.allowVersion(modPath, v); err != nil {
+			return err
+		}
+		if err := def.allowSourceVersion(modPath, v); err != nil {
+			return err
+		}
+		return pol.allow(clone, modPath, v)
+	}
+	// The code comes from the module's source, if it has one, and so do
+	// the analyses of it.
+	fetchPath := def.fetchPath(modPath, upstreamPath)
+	if s := def.source(modPath); s != nil && s.Version != "" {
+		// A pinned source version needn't be listed upstream, as with a
+		// commit on a fork.
+		switch rest {
+		case "list":
+			return filterList(&artifact{status: http.StatusOK, header: http.Header{}, body: []byte(s.Version + "\n")}, check), nil
+		case "@latest":
+			ev, err := module.EscapeVersion(s.Version)
+			if err != nil {
+				return nil, err
+			}
+			rest = ev + ".info"
+		}
+	}
+	if v, ok := restVersion(rest); ok && !strings.HasSuffix(rest, ".info") {
+		if err := check(v); err != nil {
+			return nil, err
+		}
+	}
+	if ev, ok := strings.CutSuffix(rest, ".goclone.json"); ok {
+		if def == nil || !def.Namespace {
+			return nil, notFound("%s: clone %q doesn't namespace registry names", modPath, clone)
+		}
+		v, err := module.UnescapeVersion(ev)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadGateway)
-			return
+			return nil, notFound("%v", err)
 		}
-		var modData []byte
-		if strings.HasSuffix(trimmed, ".mod") {
-			modData = data
-		} else {
+		// The manifest is an analysis of the module, so the clone and the
+		// policy must allow the version as for its zip.
+		if err := check(v); err != nil {
+			return nil, err
+		}
+		m, err := namespaceManifestFor(fetchPath, ev, def.patchesFor(modPath, v), namespaceSuffix(clone))
+		if err != nil {
+			return nil, err
+		}
+		b, err := json.MarshalIndent(m, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		header := http.Header{"Content-Type": {"application/json"}}
+		return &artifact{status: http.StatusOK, header: header, body: append(b, '\n')}, nil
+	}
+	up, err := fetchUpstream(fetchPath, rest)
+	if err != nil {
+		return nil, err
+	}
+	if up.status != http.StatusOK {
+		return up, nil
+	}
+	isZip, isMod := strings.HasSuffix(rest, ".zip"), strings.HasSuffix(rest, ".mod")
+	switch {
+	case rest == "list":
+		return filterList(up, check), nil
+	case rest == "@latest" || strings.HasSuffix(rest, ".info"):
+		// The query may have been a branch or commit, so check the version
+		// it resolved to.
+		v, err := infoVersion(up.body)
+		if err != nil {
+			return nil, err
+		}
+		if err := check(v); err != nil {
+			if rest == "@latest" {
+				return latestAllowed(fetchPath, check)
+			}
+			return nil, err
+		}
+		return up, nil
+	case !isZip && !isMod:
+		return up, nil
+	}
+	data := up.body
+	modData := data
+	if isZip {
+		var ok bool
+		modData, ok = upstreamMods.get(fetchPath + "@" + strings.TrimSuffix(rest, ".zip"))
+		if !ok {
 			modData, err = extractGoModFromZip(data)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusBadGateway)
-				return
+				return nil, &statusError{http.StatusBadGateway, err}
 			}
 		}
-		repl, err := makeReplacements(userPath, upstreamPath, modData)
+	}
+	// Patches before import rewriting apply to the code as fetched, so
+	// that what is rewritten and the reports on it see them.
+	v, _ := restVersion(rest)
+	ev := strings.TrimSuffix(strings.TrimSuffix(rest, ".zip"), ".mod")
+	patches := def.patchesFor(modPath, v)
+	if patches != nil {
+		if modData, err = patchGoMod(modData, patches.before); err != nil {
+			return nil, patchError(modPath, v, err)
+		}
+		if isMod {
+			data = modData
+		} else if data, err = patchZip(data, patches.before, nil); err != nil {
+			return nil, patchError(modPath, v, err)
+		}
+	}
+	var extra []string
+	if def != nil && def.AutoRecursive {
+		var zipData []byte
+		if isZip {
+			zipData = data
+		}
+		rep, err := depsReportFor(fetchPath, ev, patches, zipData)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return nil, err
+		}
+		for _, d := range rep.Deps {
+			extra = append(extra, d.Module)
+		}
+	}
+	repl, err := makeReplacements(userPath, upstreamPath, modData, extra...)
+	if err != nil {
+		return nil, err
+	}
+	header := up.header
+	if isZip {
+		if pol.Licenses != nil {
+			rep, err := licenseReportFor(fetchPath, ev, patches, data)
+			if err != nil {
+				return nil, err
+			}
+			if err := pol.Licenses.allow(modPath, rep); err != nil {
+				return nil, err
+			}
+		}
+		if def != nil && def.WarnRegistrations {
+			header = warnRegistrations(header, userPath, fetchPath, ev, patches, data)
 		}
-		if strings.HasSuffix(trimmed, ".zip") {
-			data, err = rewriteZip(data, repl)
+		var xforms []transform
+		if def != nil && def.Namespace {
+			xforms = append(xforms, registryNamespacer{namespaceSuffix(clone)})
+		}
+		if def != nil && def.CgoPrefix {
+			rep, err := cgoReportFor(fetchPath, ev, patches, data)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return nil, err
 			}
-		} else { // .mod
-			data, err = rewriteGoMod(data, repl)
+			if len(rep.Problems) > 0 {
+				return nil, cgoProblemError(rep)
+			}
+			if len(rep.Symbols) > 0 {
+				xforms = append(xforms, newCgoPrefixer(rep.Symbols, cgoPrefix(clone)))
+			}
+		}
+		if def != nil {
+			if data, err = slimZip(data, def.Slim); err != nil {
+				return nil, err
+			}
+		}
+		if def != nil && def.RenamePackages {
+			r, err := newPackageRenamer(modPath, data, repl, packageSuffix(clone))
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
+				return nil, err
 			}
+			xforms = append(xforms, r)
 		}
-		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
-		w.WriteHeader(resp.StatusCode)
-		w.Write(data)
-		return
+		if x := newSourcePinner(def, repl); x != nil {
+			xforms = append(xforms, x)
+		}
+		data, err = rewriteZip(data, repl, xforms...)
+	} else {
+		var xforms []transform
+		if x := newSourcePinner(def, repl); x != nil {
+			xforms = append(xforms, x)
+		}
+		data, err = rewriteModFile(data, repl, xforms)
 	}
+	if err != nil {
+		return nil, err
+	}
+	if patches != nil {
+		if isZip {
+			data, err = patchZip(data, patches.after, patches.record())
+		} else {
+			data, err = patchGoMod(data, patches.after)
+		}
+		if err != nil {
+			return nil, patchError(modPath, v, err)
+		}
+		header = header.Clone()
+		header.Set("X-Goclone-Patches", patches.names())
+	}
+	if isZip && def != nil && def.Notice {
+		clonePath, err := module.UnescapePath(*host + "/" + userPath)
+		if err != nil {
+			return nil, notFound("%v", err)
+		}
+		if data, err = noticeZip(up.body, data, modPath, v, def.cloneChanges(clone, modPath, clonePath, patches)); err != nil {
+			return nil, err
+		}
+	}
+	return &artifact{status: up.status, header: header, body: data}, nil
+}
 
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+// latestAllowed returns the .info of the highest listed version of
+// upstreamPath for which check succeeds, for when the upstream's latest
+// version isn't allowed.
+func latestAllowed(upstreamPath string, check func(v string) error) (*artifact, error) {
+	list, err := fetchUpstream(upstreamPath, "list")
+	if err != nil {
+		return nil, err
+	}
+	vers := strings.Fields(string(filterList(list, check).body))
+	if list.status != http.StatusOK || len(vers) == 0 {
+		return nil, notFound("%s: no allowed versions", upstreamPath)
+	}
+	semver.Sort(vers)
+	ev, err := module.EscapeVersion(vers[len(vers)-1])
+	if err != nil {
+		return nil, err
+	}
+	return fetchUpstream(upstreamPath, ev+".info")
+}
+
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	trimmed := strings.TrimPrefix(r.URL.Path, "/_mod/")
+	trimmed = strings.TrimPrefix(trimmed, *host+"/")
+	userPath, upstreamPath, rest, ok := parseProxyPath(trimmed)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if err := authorize(r, userPath); err != nil {
+		writeError(w, err)
+		return
+	}
+	a, err := artifactFlights.do(userPath+"/@v/"+rest, func() (*artifact, error) {
+		return buildArtifact(userPath, upstreamPath, rest)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for k, v := range a.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(a.body)))
+	w.WriteHeader(a.status)
+	w.Write(a.body)
 }
 
 // lambdaRequest is a minimal subset of the Lambda Function URL event.
@@ -462,7 +1010,29 @@ func lambdaLoop() {
 
 func main() {
 	flag.Parse()
+	if err := flagsFromEnv(); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := parseUpstream(*upstream); err != nil {
+		log.Fatal(err)
+	}
+	c, err := loadConfig(*confFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf = c
+	p, err := loadPolicy(*polFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pol = p
+	for p, spec := range localModules {
+		if _, err := newLocalSource(p, spec); err != nil {
+			log.Fatal(err)
+		}
+	}
 	http.HandleFunc("/_mod/", proxyHandler)
+	http.HandleFunc("/_report/", reportHandler)
 	http.HandleFunc("/", indexHandler)
 	if os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
 		lambdaLoop()
@@ -3,14 +3,19 @@ package main
 import (
 	"archive/zip"
 	"bytes"
+	"fmt"
 	"go/parser"
 	"go/token"
 	modfile "golang.org/x/mod/modfile"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"path"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRewriteGoImports(t *testing.T) {
@@ -203,14 +208,14 @@ func TestRewriteZipWithPrefix(t *testing.T) {
 }
 
 func TestVanityHandler(t *testing.T) {
-	host = stringPtr("example.com")
+	useUpstream(t, "off")
 	req := httptest.NewRequest("GET", "/pkg?go-get=1", nil)
 	w := httptest.NewRecorder()
 	vanityHandler(w, req)
 	if w.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d", w.Code)
 	}
-	expected := "<meta name=\"go-import\" content=\"example.com/pkg mod https://example.com/_mod/\">"
+	expected := "<meta name=\"go-import\" content=\"goclone.example.com/pkg mod https://goclone.example.com/_mod/\">"
 	if w.Body.String() != expected {
 		t.Errorf("unexpected body: %s", w.Body.String())
 	}
@@ -225,6 +230,27 @@ func TestVanityHandler(t *testing.T) {
 
 func stringPtr(s string) *string { return &s }
 
+// serveUpstream starts a server for h and makes it the upstream proxy of
+// goclone.example.com, as useUpstream does. The server closes when the test
+// ends.
+func serveUpstream(t *testing.T, h http.Handler) {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	useUpstream(t, srv.URL)
+}
+
+// useUpstream serves goclone.example.com from the upstream up, in GOPROXY
+// list syntax. The host, upstream and configuration are restored when the
+// test ends, so the test may change the configuration freely.
+func useUpstream(t *testing.T, up string) {
+	t.Helper()
+	h, u, c := host, upstream, conf
+	t.Cleanup(func() { host, upstream, conf = h, u, c })
+	host = stringPtr("goclone.example.com")
+	upstream = stringPtr(up)
+}
+
 func TestParseProxyPath(t *testing.T) {
 	up, orig, rest, ok := parseProxyPath("_two/golang.org/x/text/@v/list")
 	if !ok {
@@ -237,4 +263,195 @@ func TestParseProxyPath(t *testing.T) {
 	if ok {
 		t.Fatal("expected failure for reserved clone name")
 	}
+	_, orig, rest, ok = parseProxyPath("_two/golang.org/x/text/@latest")
+	if !ok || orig != "golang.org/x/text" || rest != "@latest" {
+		t.Fatalf("unexpected result for @latest: %q %q %v", orig, rest, ok)
+	}
+}
+
+func TestRewriteZipRawCopy(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	prefix := "old/mod@v1.0.0/"
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	asset, _ := w.CreateHeader(&zip.FileHeader{Name: prefix + "asset.txt", Method: zip.Store, Modified: mtime})
+	asset.Write([]byte("old/mod is mentioned here but not rewritten"))
+	other, _ := w.CreateHeader(&zip.FileHeader{Name: prefix + "other.go", Method: zip.Deflate, Modified: mtime})
+	other.Write([]byte("package foo\nimport \"fmt\""))
+	gof, _ := w.Create(prefix + "foo.go")
+	gof.Write([]byte("package foo\nimport \"old/mod/pkg\""))
+	w.Close()
+
+	out, err := rewriteZip(buf.Bytes(), map[string]string{"old/mod": "example.com/_two/old/mod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		rc, _ := f.Open()
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		switch f.Name {
+		case "example.com/_two/old/mod@v1.0.0/asset.txt":
+			if f.Method != zip.Store || !f.Modified.Equal(mtime) {
+				t.Errorf("asset.txt header not preserved: %v %v", f.Method, f.Modified)
+			}
+			if string(data) != "old/mod is mentioned here but not rewritten" {
+				t.Errorf("asset.txt changed: %s", data)
+			}
+		case "example.com/_two/old/mod@v1.0.0/other.go":
+			if !f.Modified.Equal(mtime) {
+				t.Errorf("other.go was not raw copied")
+			}
+		case "example.com/_two/old/mod@v1.0.0/foo.go":
+			if !bytes.Contains(data, []byte("example.com/_two/old/mod/pkg")) {
+				t.Errorf("foo.go import not rewritten: %s", data)
+			}
+		default:
+			t.Errorf("unexpected file %s", f.Name)
+		}
+	}
+}
+
+func TestMayContainPath(t *testing.T) {
+	repl := map[string]string{"old/mod": "new/mod"}
+	if !mayContainPath([]byte("import \"old/mod/pkg\""), repl) {
+		t.Error("expected match")
+	}
+	if mayContainPath([]byte("import \"fmt\""), repl) {
+		t.Error("unexpected match")
+	}
+}
+
+func TestRewriteZipParallelOrder(t *testing.T) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for i := range 50 {
+		f, _ := w.Create(fmt.Sprintf("old/mod@v1.0.0/p%d/p.go", i))
+		fmt.Fprintf(f, "package p%d\nimport \"old/mod/pkg\"\n", i)
+		a, _ := w.Create(fmt.Sprintf("old/mod@v1.0.0/p%d/data.txt", i))
+		fmt.Fprintf(a, "data %d\n", i)
+	}
+	w.Close()
+	repl := map[string]string{"old/mod": "example.com/_two/old/mod"}
+
+	defer func(n int) { *workers = n }(*workers)
+	*workers = 1
+	serial, err := rewriteZip(buf.Bytes(), repl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	*workers = 8
+	parallel, err := rewriteZip(buf.Bytes(), repl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(serial, parallel) {
+		t.Error("parallel rewrite differs from serial rewrite")
+	}
+}
+
+func TestFlagsFromEnv(t *testing.T) {
+	defer func(n int) { *workers = n }(*workers)
+	t.Setenv("GOCLONE_REWRITE_WORKERS", "3")
+	if err := flagsFromEnv(); err != nil {
+		t.Fatal(err)
+	}
+	if *workers != 3 {
+		t.Errorf("expected 3 workers, got %d", *workers)
+	}
+	t.Setenv("GOCLONE_REWRITE_WORKERS", "many")
+	if err := flagsFromEnv(); err == nil {
+		t.Error("expected error for bad value")
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	var g flightGroup[int]
+	var calls atomic.Int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := g.do("k", func() (int, error) {
+				calls.Add(1)
+				<-release
+				return 42, nil
+			})
+			if err != nil || v != 42 {
+				t.Errorf("unexpected result %v %v", v, err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected 1 call, got %d", n)
+	}
+	// Once the flight has landed, the next call runs again.
+	g.do("k", func() (int, error) { calls.Add(1); return 0, nil })
+	if n := calls.Load(); n != 2 {
+		t.Errorf("expected 2 calls, got %d", n)
+	}
+}
+
+func TestProxyHandlerDedup(t *testing.T) {
+	_, _, zipData := buildModule(t, "v1.0.0")
+	var hits atomic.Int32
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		w.Write(zipData)
+	}))
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_dd/example.com/mod/@v/v1.0.0.zip", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("unexpected status %d: %s", w.Code, w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := hits.Load(); n != 1 {
+		t.Errorf("expected 1 upstream fetch, got %d", n)
+	}
+}
+
+func TestProxyHandlerReusesMod(t *testing.T) {
+	// A zip without a go.mod can only be rewritten using the .mod file
+	// fetched before it.
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, _ := zw.Create("example.com/nomod@v1.0.0/p.go")
+	f.Write([]byte("package p\n"))
+	zw.Close()
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch path.Base(r.URL.Path) {
+		case "v1.0.0.mod":
+			w.Write([]byte("module example.com/nomod\n"))
+		case "v1.0.0.zip":
+			w.Write(buf.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	for _, ext := range []string{".mod", ".zip"} {
+		w := httptest.NewRecorder()
+		proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/example.com/nomod/@v/v1.0.0"+ext, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status %d: %s", ext, w.Code, w.Body)
+		}
+	}
 }
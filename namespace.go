@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/token"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A clone that namespaces registry names registers under names like
+// "postgres@_two" where the original registers "postgres", so that both can
+// be linked into one binary. Only registries that look things up by name
+// are namespaced; flag names and HTTP patterns are part of a program's
+// interface and are left alone.
+
+// namespacedCalls are the registering calls whose names are namespaced.
+var namespacedCalls = map[string]bool{
+	"database/sql.Register":     true,
+	"encoding/gob.RegisterName": true,
+	"expvar.Publish":            true,
+	"expvar.NewFloat":           true,
+	"expvar.NewInt":             true,
+	"expvar.NewMap":             true,
+	"expvar.NewString":          true,
+}
+
+// namespaceSuffix returns the suffix for registry names in the clone.
+// Unprefixed clones use the host, since they have no name of their own.
+func namespaceSuffix(clone string) string {
+	if clone == "" {
+		return "@" + *host
+	}
+	return "@" + clone
+}
+
+// registryNamespacer is the transform that namespaces registry names in
+// packages that can be linked into other modules' binaries, the same ones
+// findRegistrations scans. Literal names get the suffix appended; other
+// expressions get it added at run time.
+type registryNamespacer struct {
+	suffix string
+}
+
+func (n registryNamespacer) mayApply(src []byte) bool {
+	return bytes.Contains(src, []byte(`"database/sql"`)) || bytes.Contains(src, []byte(`"encoding/gob"`)) || bytes.Contains(src, []byte(`"expvar"`))
+}
+
+func (n registryNamespacer) apply(name string, fset *token.FileSet, f *ast.File) bool {
+	rel, ok := zipRelPath(name)
+	if !ok || strings.HasSuffix(rel, "_test.go") || f.Name.Name == "main" || ignoredFile(f) || !linkableDir(path.Dir(rel)) {
+		return false
+	}
+	pkg := checkFiles("", fset, []*ast.File{f})
+	changed := false
+	ast.Inspect(f, func(node ast.Node) bool {
+		call, ok := node.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		c, ok := pkg.registryCall(call)
+		if !ok || !namespacedCalls[c] {
+			return true
+		}
+		i := registryCalls[c]
+		if i >= len(call.Args) {
+			return true
+		}
+		if lit, ok := call.Args[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+			if s, err := strconv.Unquote(lit.Value); err == nil {
+				lit.Value = strconv.Quote(s + n.suffix)
+				changed = true
+				return true
+			}
+		}
+		call.Args[i] = &ast.BinaryExpr{
+			X:  &ast.ParenExpr{X: call.Args[i]},
+			Op: token.ADD,
+			Y:  &ast.BasicLit{Kind: token.STRING, Value: strconv.Quote(n.suffix)},
+		}
+		changed = true
+		return true
+	})
+	return changed
+}
+
+// namespaceManifest lists the registry names a clone renamed.
+type namespaceManifest struct {
+	Module  string                `json:"module"`
+	Version string                `json:"version"`
+	Suffix  string                `json:"suffix"`
+	Renamed []renamedRegistration `json:"renamed"`
+}
+
+// renamedRegistration is a registration whose name was namespaced. Name
+// and NewName are empty where the name isn't a string literal.
+type renamedRegistration struct {
+	registration
+	NewName string `json:"newName,omitempty"`
+}
+
+// namespaceManifestFor returns the manifest for upstreamPath at the escaped
+// version ev, patched with patches and cloned with the suffix.
+func namespaceManifestFor(upstreamPath, ev string, patches *patchSet, suffix string) (*namespaceManifest, error) {
+	rep, err := registrationsReportFor(upstreamPath, ev, patches, nil)
+	if err != nil {
+		return nil, err
+	}
+	m := &namespaceManifest{Module: rep.Module, Version: rep.Version, Suffix: suffix, Renamed: []renamedRegistration{}}
+	for _, r := range rep.Registrations {
+		if !namespacedCalls[r.Call] {
+			continue
+		}
+		rr := renamedRegistration{registration: r}
+		if r.Name != "" {
+			rr.NewName = r.Name + suffix
+		}
+		m.Renamed = append(m.Renamed, rr)
+	}
+	return m, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistryNamespacer(t *testing.T) {
+	useUpstream(t, "off")
+	zipData := buildZip(t, "example.com/reg@v1.0.0/", map[string]string{
+		"go.mod": "module example.com/reg\n",
+		"reg.go": `package reg
+
+import (
+	"database/sql"
+	"encoding/gob"
+	"expvar"
+	"flag"
+)
+
+const driver = "regdb"
+
+func init() {
+	sql.Register("regdb", nil)
+	sql.Register(driver, nil)
+	gob.RegisterName("reg.T", T{})
+	expvar.NewInt("hits")
+	flag.Bool("verbose", false, "")
+}
+
+type T struct{}
+`,
+		"reg_test.go": "package reg\n\nimport \"database/sql\"\n\nfunc init() { sql.Register(\"testdb\", nil) }\n",
+	})
+	out, err := rewriteZip(zipData, map[string]string{"example.com/reg": "goclone.example.com/_two/example.com/reg"}, registryNamespacer{namespaceSuffix("_two")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	zr, _ := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	for _, f := range zr.File {
+		b, _ := readZipFile(f)
+		files[strings.TrimPrefix(f.Name, "goclone.example.com/_two/example.com/reg@v1.0.0/")] = string(b)
+	}
+	for _, want := range []string{
+		`sql.Register("regdb@_two", nil)`,
+		`sql.Register((driver)+"@_two", nil)`,
+		`gob.RegisterName("reg.T@_two", T{})`,
+		`expvar.NewInt("hits@_two")`,
+		`flag.Bool("verbose", false, "")`,
+	} {
+		if !strings.Contains(files["reg.go"], want) {
+			t.Errorf("reg.go missing %s:\n%s", want, files["reg.go"])
+		}
+	}
+	if !strings.Contains(files["reg_test.go"], `"testdb"`) {
+		t.Errorf("test file namespaced:\n%s", files["reg_test.go"])
+	}
+	if namespaceSuffix("") != "@goclone.example.com" {
+		t.Errorf("unexpected suffix for unprefixed clone %q", namespaceSuffix(""))
+	}
+}
+
+func TestProxyHandlerNamespaceManifest(t *testing.T) {
+	mod, zipData := buildRegisteringModule(t)
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example.com/reg/@v/v1.0.0.mod":
+			w.Write(mod)
+		case "/example.com/reg/@v/v1.0.0.zip":
+			w.Write(zipData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	conf = &config{Clones: []cloneDef{
+		{Name: "_ns", Namespace: true},
+		{Name: "_nsold", Namespace: true, Versions: mustConstraint(t, "<v1.0.0")},
+	}}
+
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_ns/example.com/reg/@v/v1.0.0.goclone.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	var m namespaceManifest
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Suffix != "@_ns" || len(m.Renamed) != 2 || m.Renamed[0].Call != "database/sql.Register" || m.Renamed[0].NewName != "regdb@_ns" {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+
+	w = httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_two/example.com/reg/@v/v1.0.0.goclone.json", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("manifest for clone without namespacing: got status %d, want 404", w.Code)
+	}
+
+	// Versions the clone or the policy denies get no manifest either.
+	w = httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_nsold/example.com/reg/@v/v1.0.0.goclone.json", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("manifest for a version outside the clone's range: got status %d, want 404", w.Code)
+	}
+	defer func(p *policy) { pol = p }(pol)
+	pol = &policy{Rules: []policyRule{{Action: "deny", Modules: "example.com/reg"}}}
+	w = httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_ns/example.com/reg/@v/v1.0.0.goclone.json", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("manifest for a denied module: got status %d, want 403", w.Code)
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// A patched clone applies unified diffs to the modules it serves, to carry a
+// fix without maintaining a fork. Patches apply either to the original code
+// or to the code with its imports rewritten, and the applied patches are
+// recorded in the zip, in patchRecord, so the zip's hash covers them.
+
+// patchRecord is the file in a patched zip listing the applied patches.
+const patchRecord = "goclone.patches"
+
+// patchDef is a patch for some modules in a clone.
+type patchDef struct {
+	// Name identifies the patch in errors and in the record. It defaults
+	// to File.
+	Name string `json:"name,omitempty"`
+	// Modules is a comma-separated list of module path glob patterns,
+	// matched like GOPRIVATE, that the patch applies to. Empty matches
+	// every module in the clone.
+	Modules string `json:"modules,omitempty"`
+	// Versions restricts the patch to the versions in a range.
+	Versions *versionConstraint `json:"versions,omitempty"`
+	// Diff is the patch, a unified diff whose file names are relative to
+	// the module root, optionally under the "a/" and "b/" that git adds.
+	Diff string `json:"diff,omitempty"`
+	// File is the path of a file holding the diff, instead of Diff.
+	File string `json:"file,omitempty"`
+	// After applies the patch after imports are rewritten, so that it
+	// sees, and may add, imports of the clone. Otherwise it applies to the
+	// original code.
+	After bool `json:"after,omitempty"`
+
+	// loaded is the patch, read and parsed by check.
+	loaded *loadedPatch
+}
+
+func (p *patchDef) check() error {
+	if (p.Diff == "") == (p.File == "") {
+		return errors.New("patch needs exactly one of diff or file")
+	}
+	if p.Name == "" && p.File == "" {
+		return errors.New("patch with an inline diff needs a name")
+	}
+	lp, err := p.load()
+	if err != nil {
+		return err
+	}
+	p.loaded = lp
+	return nil
+}
+
+// load returns the patch, read and parsed.
+func (p *patchDef) load() (*loadedPatch, error) {
+	name, diff := p.Name, p.Diff
+	if name == "" {
+		name = p.File
+	}
+	if p.File != "" {
+		b, err := os.ReadFile(p.File)
+		if err != nil {
+			return nil, err
+		}
+		diff = string(b)
+	}
+	files, err := parseDiff(diff)
+	if err != nil {
+		return nil, fmt.Errorf("patch %s: %v", name, err)
+	}
+	return &loadedPatch{name: name, diff: diff, files: files}, nil
+}
+
+// loadedPatch is a patch ready to apply.
+type loadedPatch struct {
+	name  string
+	diff  string
+	files []filePatch
+}
+
+// patchSet is the patches for one version of a module.
+type patchSet struct {
+	before, after []*loadedPatch
+}
+
+// patchesFor returns the patches to apply to module p at version v, or nil
+// if there are none. The patches are those loaded when d was checked.
+func (d *cloneDef) patchesFor(p, v string) *patchSet {
+	if d == nil {
+		return nil
+	}
+	var ps patchSet
+	for _, def := range d.Patches {
+		if def.Modules != "" && !module.MatchPrefixPatterns(def.Modules, p) || !def.Versions.allows(v) {
+			continue
+		}
+		if def.After {
+			ps.after = append(ps.after, def.loaded)
+		} else {
+			ps.before = append(ps.before, def.loaded)
+		}
+	}
+	if len(ps.before) == 0 && len(ps.after) == 0 {
+		return nil
+	}
+	return &ps
+}
+
+// names returns the names of the patches, for a response header.
+func (ps *patchSet) names() string {
+	var names []string
+	for _, lp := range append(ps.before[:len(ps.before):len(ps.before)], ps.after...) {
+		names = append(names, lp.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// key identifies the before-patches, which change what the module's reports
+// see, or is empty if there are none.
+func (ps *patchSet) key() string {
+	if ps == nil || len(ps.before) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, lp := range ps.before {
+		fmt.Fprintf(h, "%s\x00%s\x00", lp.name, lp.diff)
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// record returns the contents of patchRecord.
+func (ps *patchSet) record() []byte {
+	var b bytes.Buffer
+	for _, stage := range []struct {
+		patches []*loadedPatch
+		when    string
+	}{{ps.before, "before"}, {ps.after, "after"}} {
+		for _, lp := range stage.patches {
+			fmt.Fprintf(&b, "# %s, applied %s import rewriting\n", lp.name, stage.when)
+			b.WriteString(lp.diff)
+			if !strings.HasSuffix(lp.diff, "\n") {
+				b.WriteByte('\n')
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+// patchError reports a patch that doesn't apply to modPath at version v.
+func patchError(modPath, v string, err error) error {
+	return &statusError{http.StatusUnprocessableEntity, fmt.Errorf("%s@%s: %v", modPath, v, err)}
+}
+
+// patchGoMod applies the changes that patches make to go.mod to modData.
+func patchGoMod(modData []byte, patches []*loadedPatch) ([]byte, error) {
+	for _, lp := range patches {
+		for _, fp := range lp.files {
+			if fp.newName != "go.mod" {
+				continue
+			}
+			var err error
+			if modData, err = fp.apply(modData); err != nil {
+				return nil, fmt.Errorf("patch %s: %v", lp.name, err)
+			}
+		}
+	}
+	return modData, nil
+}
+
+// patchZip applies patches to the module zip data. If record isn't nil,
+// it is added as patchRecord.
+func patchZip(data []byte, patches []*loadedPatch, record []byte) ([]byte, error) {
+	if len(patches) == 0 && record == nil {
+		return data, nil
+	}
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	root := ""
+	files := map[string]*zip.File{}
+	for _, f := range r.File {
+		rel, ok := zipRelPath(f.Name)
+		if !ok {
+			continue
+		}
+		root = strings.TrimSuffix(f.Name, rel)
+		files[rel] = f
+	}
+	// changed holds the new contents of patched files, nil if deleted.
+	changed := map[string][]byte{}
+	var added []string
+	for _, lp := range patches {
+		for _, fp := range lp.files {
+			src, ok := changed[fp.oldName]
+			if !ok && fp.oldName != "" {
+				f := files[fp.oldName]
+				if f == nil {
+					return nil, fmt.Errorf("patch %s: %s: no such file", lp.name, fp.oldName)
+				}
+				if src, err = readZipFile(f); err != nil {
+					return nil, err
+				}
+			}
+			if fp.oldName == "" && (files[fp.newName] != nil || changed[fp.newName] != nil) {
+				return nil, fmt.Errorf("patch %s: %s: file already exists", lp.name, fp.newName)
+			}
+			b, err := fp.apply(src)
+			if err != nil {
+				return nil, fmt.Errorf("patch %s: %v", lp.name, err)
+			}
+			if fp.oldName != "" && fp.oldName != fp.newName {
+				changed[fp.oldName] = nil
+			}
+			if fp.newName != "" {
+				if _, ok := files[fp.newName]; !ok {
+					if _, ok := changed[fp.newName]; !ok {
+						added = append(added, fp.newName)
+					}
+				}
+				changed[fp.newName] = b
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	write := func(name string, b []byte) error {
+		fw, err := w.CreateHeader(&zip.FileHeader{Name: root + name, Method: zip.Deflate})
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(b)
+		return err
+	}
+	for _, f := range r.File {
+		rel, _ := zipRelPath(f.Name)
+		b, ok := changed[rel]
+		switch {
+		case !ok:
+			err = copyZipFile(w, f, f.Name)
+		case b != nil:
+			err = write(rel, b)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, rel := range added {
+		if b := changed[rel]; b != nil {
+			if err := write(rel, b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if record != nil {
+		if err := write(patchRecord, record); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// filePatch is the part of a unified diff for one file. oldName is empty
+// for a new file and newName for a deleted one.
+type filePatch struct {
+	oldName, newName string
+	hunks            []hunk
+}
+
+// hunk is a change to consecutive lines of a file. Each line starts with
+// ' ', '-' or '+' and ends with a newline unless it is the last line of a
+// file without one.
+type hunk struct {
+	oldLine int
+	lines   []string
+}
+
+// parseDiff parses a unified diff.
+func parseDiff(diff string) ([]filePatch, error) {
+	lines := strings.SplitAfter(diff, "\n")
+	var fps []filePatch
+	for i := 0; i < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "--- ") {
+			// Anything before a file's header, such as git's extended
+			// headers, is commentary.
+			continue
+		}
+		if i+1 >= len(lines) || !strings.HasPrefix(lines[i+1], "+++ ") {
+			return nil, fmt.Errorf("line %d: missing +++ line", i+2)
+		}
+		fp := filePatch{oldName: diffFileName(lines[i][4:], "a/"), newName: diffFileName(lines[i+1][4:], "b/")}
+		if fp.oldName == "" && fp.newName == "" {
+			return nil, fmt.Errorf("line %d: no file names", i+1)
+		}
+		i += 2
+		for i < len(lines) && strings.HasPrefix(lines[i], "@@ ") {
+			h, n, err := parseHunk(lines[i:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			fp.hunks = append(fp.hunks, h)
+			i += n
+		}
+		if len(fp.hunks) == 0 {
+			return nil, fmt.Errorf("%s: no hunks", fp.newName)
+		}
+		fps = append(fps, fp)
+		i--
+	}
+	if len(fps) == 0 {
+		return nil, errors.New("no files in diff")
+	}
+	return fps, nil
+}
+
+// diffFileName returns the file name in a ---/+++ line, without the prefix
+// git adds, or "" for /dev/null.
+func diffFileName(s, prefix string) string {
+	s = strings.TrimRight(s, "\r\n")
+	// A tab ends the name, before an optional timestamp.
+	s, _, _ = strings.Cut(s, "\t")
+	if q, err := strconv.Unquote(s); err == nil {
+		s = q
+	}
+	if s == "/dev/null" {
+		return ""
+	}
+	return strings.TrimPrefix(s, prefix)
+}
+
+// parseHunk parses the hunk at the start of lines, returning it and the
+// number of lines it takes up.
+func parseHunk(lines []string) (hunk, int, error) {
+	var oldLine, oldCount, newLine, newCount int
+	header := strings.TrimRight(lines[0], "\r\n")
+	fields := strings.Fields(header)
+	if len(fields) < 4 || fields[3] != "@@" || !parseRange(fields[1], "-", &oldLine, &oldCount) || !parseRange(fields[2], "+", &newLine, &newCount) {
+		return hunk{}, 0, fmt.Errorf("malformed hunk header %q", header)
+	}
+	h := hunk{oldLine: oldLine}
+	n := 1
+	for oldCount > 0 || newCount > 0 {
+		if n >= len(lines) || lines[n] == "" {
+			return hunk{}, 0, errors.New("hunk is too short")
+		}
+		line := lines[n]
+		if line == "\n" {
+			// Editors drop the space from blank context lines.
+			line = " \n"
+		}
+		switch line[0] {
+		case ' ':
+			oldCount--
+			newCount--
+		case '-':
+			oldCount--
+		case '+':
+			newCount--
+		default:
+			return hunk{}, 0, fmt.Errorf("unexpected line %q in hunk", strings.TrimRight(line, "\n"))
+		}
+		if oldCount < 0 || newCount < 0 {
+			return hunk{}, 0, errors.New("hunk is longer than its header says")
+		}
+		h.lines = append(h.lines, line)
+		n++
+		if n < len(lines) && strings.HasPrefix(lines[n], `\`) {
+			// "\ No newline at end of file"
+			h.lines[len(h.lines)-1] = strings.TrimSuffix(line, "\n")
+			n++
+		}
+	}
+	return h, n, nil
+}
+
+// parseRange parses a hunk range like "-12,3", or "-12" for one line.
+func parseRange(s, sign string, line, count *int) bool {
+	s, ok := strings.CutPrefix(s, sign)
+	if !ok {
+		return false
+	}
+	l, c, hasCount := strings.Cut(s, ",")
+	var err error
+	if *line, err = strconv.Atoi(l); err != nil {
+		return false
+	}
+	*count = 1
+	if hasCount {
+		if *count, err = strconv.Atoi(c); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// apply returns src with the patch applied. A hunk whose lines have moved
+// applies at the nearest place it matches, as with patch(1), but its
+// context must match exactly.
+func (fp *filePatch) apply(src []byte) ([]byte, error) {
+	name := fp.newName
+	if name == "" {
+		name = fp.oldName
+	}
+	lines := strings.SplitAfter(string(src), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	var out []string
+	// drift is how far the last hunk was from where it said it was.
+	next, drift := 0, 0
+	for i, h := range fp.hunks {
+		var old, repl []string
+		for _, l := range h.lines {
+			if l[0] != '+' {
+				old = append(old, l[1:])
+			}
+			if l[0] != '-' {
+				repl = append(repl, l[1:])
+			}
+		}
+		expected := h.oldLine - 1
+		if len(old) == 0 {
+			// A pure insertion goes after line oldLine.
+			expected++
+		}
+		want := expected + drift
+		at := -1
+		for off := 0; at < 0 && (want-off >= next || want+off <= len(lines)-len(old)); off++ {
+			for _, pos := range []int{want - off, want + off} {
+				if pos >= next && pos <= len(lines)-len(old) && slices.Equal(lines[pos:pos+len(old)], old) {
+					at = pos
+					break
+				}
+			}
+		}
+		if at < 0 {
+			return nil, fmt.Errorf("%s: hunk #%d at line %d doesn't apply", name, i+1, h.oldLine)
+		}
+		out = append(out, lines[next:at]...)
+		out = append(out, repl...)
+		next = at + len(old)
+		drift = at - expected
+	}
+	out = append(out, lines[next:]...)
+	if fp.newName == "" && len(out) > 0 {
+		return nil, fmt.Errorf("%s: deleted file has more lines than the patch removes", name)
+	}
+	return []byte(strings.Join(out, "")), nil
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFilePatchApply(t *testing.T) {
+	src := "one\ntwo\nthree\nfour\nfive\nsix\n"
+	tests := []struct {
+		name, diff, want, err string
+	}{
+		{
+			name: "exact",
+			diff: "--- a/f\n+++ b/f\n@@ -2,3 +2,3 @@\n two\n-three\n+THREE\n four\n",
+			want: "one\ntwo\nTHREE\nfour\nfive\nsix\n",
+		},
+		{
+			name: "moved",
+			diff: "--- f\n+++ f\n@@ -4,2 +4,3 @@\n five\n+5.5\n six\n",
+			want: "one\ntwo\nthree\nfour\nfive\n5.5\nsix\n",
+		},
+		{
+			name: "two hunks",
+			diff: "--- f\n+++ f\n@@ -1 +1 @@\n-one\n+ONE\n@@ -6 +6,2 @@\n six\n+seven\n",
+			want: "ONE\ntwo\nthree\nfour\nfive\nsix\nseven\n",
+		},
+		{
+			name: "insertion",
+			diff: "--- f\n+++ f\n@@ -0,0 +1 @@\n+zero\n",
+			want: "zero\none\ntwo\nthree\nfour\nfive\nsix\n",
+		},
+		{
+			name: "no newline",
+			diff: "--- f\n+++ f\n@@ -6 +6 @@\n-six\n+six\n\\ No newline at end of file\n",
+			want: "one\ntwo\nthree\nfour\nfive\nsix",
+		},
+		{
+			name: "conflict",
+			diff: "--- f\n+++ f\n@@ -3 +3 @@\n-tree\n+THREE\n",
+			err:  "f: hunk #1 at line 3 doesn't apply",
+		},
+	}
+	for _, tt := range tests {
+		fps, err := parseDiff(tt.diff)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got, err := fps[0].apply([]byte(src))
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseDiffErrors(t *testing.T) {
+	for _, diff := range []string{
+		"",
+		"--- a/f\n",
+		"--- a/f\n+++ b/f\n",
+		"--- a/f\n+++ b/f\n@@ -1,2 +1,2 @@\n-one\n+ONE\n",
+		"--- a/f\n+++ b/f\n@@ -1 +1 @@\n*one\n",
+		"--- /dev/null\n+++ /dev/null\n@@ -0,0 +1 @@\n+x\n",
+	} {
+		if _, err := parseDiff(diff); err == nil {
+			t.Errorf("parseDiff(%q) succeeded", diff)
+		}
+	}
+}
+
+func TestPatchZip(t *testing.T) {
+	zipData := buildZip(t, "example.com/m@v1.0.0/", map[string]string{
+		"go.mod":   "module example.com/m\n",
+		"a.go":     "package m\n\nconst A = 1\n",
+		"old.go":   "package m\n",
+		"sub/b.go": "package sub\n",
+	})
+	lp, err := (&patchDef{Name: "fix", Diff: `diff --git a/a.go b/a.go
+index 0000000..1111111 100644
+--- a/a.go
++++ b/a.go
+@@ -1,3 +1,3 @@
+ package m
+
+-const A = 1
++const A = 2
+--- a/old.go
++++ /dev/null
+@@ -1 +0,0 @@
+-package m
+--- /dev/null
++++ b/new.go
+@@ -0,0 +1 @@
++package m
+`}).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := patchZip(zipData, []*loadedPatch{lp}, []byte("record\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, f := range zr.File {
+		b, _ := readZipFile(f)
+		got[strings.TrimPrefix(f.Name, "example.com/m@v1.0.0/")] = string(b)
+	}
+	want := map[string]string{
+		"go.mod":    "module example.com/m\n",
+		"a.go":      "package m\n\nconst A = 2\n",
+		"sub/b.go":  "package sub\n",
+		"new.go":    "package m\n",
+		patchRecord: "record\n",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	lp.files[0].hunks[0].lines[2] = "-const A = 3\n"
+	if _, err := patchZip(zipData, []*loadedPatch{lp}, nil); err == nil || !strings.Contains(err.Error(), "patch fix: a.go: hunk #1 at line 1 doesn't apply") {
+		t.Errorf("conflicting patch: got %v", err)
+	}
+}
+
+func TestPatchesForLoadedOnce(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "fix.diff")
+	diff := "--- a/a.go\n+++ b/a.go\n@@ -1 +1 @@\n-x\n+y\n"
+	if err := os.WriteFile(file, []byte(diff), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	d := &cloneDef{Name: "_once", Patches: []patchDef{{File: file}}}
+	if err := d.check(); err != nil {
+		t.Fatal(err)
+	}
+	// The file is read when the config is checked, not per request.
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	ps := d.patchesFor("example.com/once", "v1.0.0")
+	if ps == nil || len(ps.before) != 1 || ps.before[0].name != file || ps.before[0].diff != diff {
+		t.Errorf("patchesFor = %+v", ps)
+	}
+}
+
+func TestProxyHandlerPatches(t *testing.T) {
+	files := map[string]string{
+		"go.mod":   "module example.com/patchme\n\ngo 1.21\n",
+		"a.go":     "package patchme\n\nimport \"example.com/patchme/sub\"\n\nvar X = sub.Y\n",
+		"sub/b.go": "package sub\n\nconst Y = 1\n",
+	}
+	mux := http.NewServeMux()
+	for _, v := range []string{"v1.0.0", "v2.0.0+incompatible"} {
+		zipData := buildZip(t, "example.com/patchme@"+v+"/", files)
+		mux.HandleFunc("/example.com/patchme/@v/"+v+".mod", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, files["go.mod"]) })
+		mux.HandleFunc("/example.com/patchme/@v/"+v+".zip", func(w http.ResponseWriter, r *http.Request) { w.Write(zipData) })
+	}
+	serveUpstream(t, mux)
+	conf = &config{Clones: []cloneDef{{Name: "_hotfix", Patches: []patchDef{
+		{
+			Name:     "bump",
+			Versions: mustConstraint(t, "<v2.0.0"),
+			Diff:     "--- a/sub/b.go\n+++ b/sub/b.go\n@@ -3 +3 @@\n-const Y = 1\n+const Y = 2\n",
+		},
+		{
+			Name:  "after",
+			After: true,
+			Diff:  "--- a/a.go\n+++ b/a.go\n@@ -3 +3 @@\n-import \"goclone.example.com/_hotfix/example.com/patchme/sub\"\n+import sub \"goclone.example.com/_hotfix/example.com/patchme/sub\"\n--- a/go.mod\n+++ b/go.mod\n@@ -3 +3 @@\n-go 1.21\n+go 1.22\n",
+		},
+		{
+			Name:    "elsewhere",
+			Modules: "example.com/other",
+			Diff:    "--- a/nothere.go\n+++ b/nothere.go\n@@ -1 +1 @@\n-x\n+y\n",
+		},
+	}}}}
+	if err := conf.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(rest string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_hotfix/example.com/patchme/"+rest, nil))
+		return w
+	}
+	w := get("@v/v1.0.0.mod")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "go 1.22") {
+		t.Errorf("mod: %d %s", w.Code, w.Body)
+	}
+	w = get("@v/v1.0.0.zip")
+	if w.Code != http.StatusOK {
+		t.Fatalf("zip: %d %s", w.Code, w.Body)
+	}
+	if h := w.Header().Get("X-Goclone-Patches"); h != "bump, after" {
+		t.Errorf("X-Goclone-Patches = %q", h)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, f := range zr.File {
+		b, _ := readZipFile(f)
+		got[path.Base(f.Name)] = string(b)
+	}
+	if !strings.Contains(got["b.go"], "const Y = 2") {
+		t.Errorf("b.go not patched:\n%s", got["b.go"])
+	}
+	if !strings.Contains(got["a.go"], `import sub "goclone.example.com/_hotfix/example.com/patchme/sub"`) {
+		t.Errorf("a.go not patched:\n%s", got["a.go"])
+	}
+	if !strings.Contains(got[patchRecord], "# bump, applied before import rewriting\n") || !strings.Contains(got[patchRecord], "# after, applied after import rewriting\n") {
+		t.Errorf("%s:\n%s", patchRecord, got[patchRecord])
+	}
+
+	// Outside its versions the first patch doesn't apply.
+	w = get("@v/v2.0.0+incompatible.zip")
+	if w.Code != http.StatusOK || w.Header().Get("X-Goclone-Patches") != "after" {
+		t.Errorf("v2 zip: %d %q", w.Code, w.Header().Get("X-Goclone-Patches"))
+	}
+
+	conf.Clones[0].Patches[1].Diff = strings.Replace(conf.Clones[0].Patches[1].Diff, "go 1.21", "go 1.20", 1)
+	if err := conf.check(); err != nil {
+		t.Fatal(err)
+	}
+	w = get("@v/v1.0.0.mod")
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "patch after: go.mod: hunk #1 at line 3 doesn't apply") {
+		t.Errorf("conflicting patch: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestProxyHandlerPatchedReports(t *testing.T) {
+	files := map[string]string{
+		"go.mod": "module example.com/patchreg\n\ngo 1.21\n",
+		"a.go":   "package patchreg\n\nimport \"flag\"\n\nvar _ = flag.Parsed\n",
+	}
+	zipData := buildZip(t, "example.com/patchreg@v1.0.0/", files)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/example.com/patchreg/@v/v1.0.0.mod", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, files["go.mod"]) })
+	mux.HandleFunc("/example.com/patchreg/@v/v1.0.0.zip", func(w http.ResponseWriter, r *http.Request) { w.Write(zipData) })
+	serveUpstream(t, mux)
+	conf = &config{Clones: []cloneDef{
+		{Name: "_plain", WarnRegistrations: true},
+		{Name: "_regfix", WarnRegistrations: true, Patches: []patchDef{{
+			Name: "flag",
+			Diff: "--- a/a.go\n+++ b/a.go\n@@ -5 +5 @@\n-var _ = flag.Parsed\n+var V = flag.Bool(\"v\", false, \"\")\n",
+		}}},
+	}}
+	if err := conf.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The unpatched module is scanned first, so the patched one must not
+	// share its report.
+	for _, c := range []struct {
+		clone, warning string
+	}{
+		{"_plain", ""},
+		{"_regfix", "example.com/patchreg makes 1 global registrations"},
+	} {
+		w := httptest.NewRecorder()
+		proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/"+c.clone+"/example.com/patchreg/@v/v1.0.0.zip", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", c.clone, w.Code, w.Body)
+		}
+		if got := w.Header().Get("X-Goclone-Warning"); !strings.HasPrefix(got, c.warning) || (c.warning == "") != (got == "") {
+			t.Errorf("%s: X-Goclone-Warning = %q, want %q", c.clone, got, c.warning)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	reportHandler(w, httptest.NewRequest("GET", "/_report/registrations/goclone.example.com/_regfix/example.com/patchreg@v1.0.0", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"flag.Bool"`) {
+		t.Errorf("report: %d %s", w.Code, w.Body)
+	}
+}
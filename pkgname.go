@@ -0,0 +1,252 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// A clone that renames packages gives each package a name ending in the
+// clone name, like "text_two" for package text in clone _two, so that code
+// importing the package from two clones needs no import names and goimports
+// can tell the copies apart. Files in the module that refer to a renamed
+// package by its old name are fixed up, which takes type information: an
+// identifier "text" may as well be a local variable. Imports of other
+// modules cloned along with the module get explicit names, since those
+// modules may have been renamed too.
+
+// packageSuffix returns the suffix for package names in the clone.
+// Unprefixed clones use the host, since they have no name of their own.
+func packageSuffix(clone string) string {
+	if clone == "" {
+		clone = *host
+	}
+	b := []byte("_" + strings.TrimPrefix(clone, "_"))
+	for i, c := range b {
+		if !isCIdent(c) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// packageRenamer is the transform that renames the packages in a module.
+type packageRenamer struct {
+	modPath string
+	suffix  string
+	// names maps the import path of each package in the module to its
+	// original name. Commands aren't renamed, so they aren't listed.
+	names map[string]string
+	// aliases maps the zip entry name of a file to the names to give its
+	// unnamed imports of other cloned modules, by import path.
+	aliases map[string]map[string]string
+	// hints are the package clauses and quoted import paths of which a file
+	// the transform may change contains one.
+	hints [][]byte
+}
+
+// newPackageRenamer returns the transform that renames the packages of
+// modPath in zipData, whose imports are rewritten with repl.
+func newPackageRenamer(modPath string, zipData []byte, repl map[string]string, suffix string) (*packageRenamer, error) {
+	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, &statusError{http.StatusBadGateway, err}
+	}
+	fset := token.NewFileSet()
+	dirs := map[string][]*ast.File{}
+	for _, f := range zr.File {
+		name, ok := zipRelPath(f.Name)
+		if !ok || !strings.HasSuffix(name, ".go") || !linkableDir(path.Dir(name)) {
+			continue
+		}
+		src, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		af, err := parser.ParseFile(fset, f.Name, src, parser.ParseComments)
+		if err != nil || ignoredFile(af) {
+			continue
+		}
+		dirs[path.Dir(name)] = append(dirs[path.Dir(name)], af)
+	}
+
+	r := &packageRenamer{modPath: modPath, suffix: suffix, names: map[string]string{}, aliases: map[string]map[string]string{}}
+	var known []*types.Package
+	for dir, files := range dirs {
+		var lib []*ast.File
+		for _, af := range files {
+			if !strings.HasSuffix(fset.Position(af.Package).Filename, "_test.go") {
+				lib = append(lib, af)
+			}
+		}
+		if lib = primaryPackage(lib); len(lib) > 0 {
+			p := r.pkgPath(dir)
+			r.names[p] = lib[0].Name.Name
+			pkg := types.NewPackage(p, lib[0].Name.Name)
+			pkg.MarkComplete()
+			known = append(known, pkg)
+		}
+	}
+
+	// Imports of other cloned modules are named after what the files call
+	// them, which is only known by checking whole packages: where the name
+	// guessed from the path is wrong, the uses are left undefined.
+	cloned := func(p string) bool {
+		_, inModule := r.names[p]
+		return !inModule && rewritePath(p, repl) != p
+	}
+	for dir, files := range dirs {
+		byName := map[string][]*ast.File{}
+		for _, af := range files {
+			byName[af.Name.Name] = append(byName[af.Name.Name], af)
+		}
+		for name, files := range byName {
+			p := r.pkgPath(dir)
+			if strings.HasSuffix(name, "_test") {
+				p += "_test"
+			}
+			pkg := checkFiles(p, fset, files, known...)
+			for _, af := range files {
+				if a := pkg.importNames(af, cloned); len(a) > 0 {
+					r.aliases[fset.Position(af.Package).Filename] = a
+				}
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	hint := func(h string) {
+		if !seen[h] {
+			seen[h] = true
+			r.hints = append(r.hints, []byte(h))
+		}
+	}
+	hint(strconv.Quote(modPath))
+	hint(`"` + modPath + `/`)
+	for _, name := range r.names {
+		hint("package " + name)
+	}
+	for _, a := range r.aliases {
+		for ip := range a {
+			hint(strconv.Quote(ip))
+		}
+	}
+	return r, nil
+}
+
+// pkgPath returns the import path of the package in dir, relative to the
+// module root.
+func (r *packageRenamer) pkgPath(dir string) string {
+	if dir == "." {
+		return r.modPath
+	}
+	return r.modPath + "/" + dir
+}
+
+// importNames returns the names f uses for its unnamed imports of the
+// packages that want accepts, by import path.
+func (p *zipPackage) importNames(f *ast.File, want func(string) bool) map[string]string {
+	used := map[types.Object]bool{}
+	undefined := map[string]bool{}
+	ast.Inspect(f, func(n ast.Node) bool {
+		if sel, ok := n.(*ast.SelectorExpr); ok {
+			if id, ok := sel.X.(*ast.Ident); ok {
+				if obj := p.info.Uses[id]; obj != nil {
+					used[obj] = true
+				} else {
+					undefined[id.Name] = true
+				}
+			}
+		}
+		return true
+	})
+	names := map[string]string{}
+	var missed []string
+	for _, imp := range f.Imports {
+		ip, err := strconv.Unquote(imp.Path.Value)
+		if err != nil || imp.Name != nil || !want(ip) {
+			continue
+		}
+		if pn := p.info.Implicits[imp]; pn != nil && used[pn] {
+			names[ip] = pn.Name()
+		} else {
+			missed = append(missed, ip)
+		}
+	}
+	// A single wrong guess can be put right from the single undefined
+	// qualifier; more are ambiguous.
+	if len(missed) == 1 && len(undefined) == 1 {
+		for name := range undefined {
+			names[missed[0]] = name
+		}
+	}
+	return names
+}
+
+func (r *packageRenamer) mayApply(src []byte) bool {
+	for _, h := range r.hints {
+		if bytes.Contains(src, h) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *packageRenamer) apply(name string, fset *token.FileSet, f *ast.File) bool {
+	rel, ok := zipRelPath(name)
+	if !ok || !linkableDir(path.Dir(rel)) {
+		return false
+	}
+	changed := false
+	if old, ok := r.names[r.pkgPath(path.Dir(rel))]; ok {
+		switch f.Name.Name {
+		case old:
+			f.Name.Name = old + r.suffix
+			changed = true
+		case old + "_test":
+			f.Name.Name = old + r.suffix + "_test"
+			changed = true
+		}
+	}
+	var known []*types.Package
+	for _, imp := range f.Imports {
+		ip, err := strconv.Unquote(imp.Path.Value)
+		if err != nil || imp.Name != nil {
+			continue
+		}
+		if old, ok := r.names[ip]; ok {
+			pkg := types.NewPackage(ip, old)
+			pkg.MarkComplete()
+			known = append(known, pkg)
+		} else if alias, ok := r.aliases[name][ip]; ok {
+			imp.Name = ast.NewIdent(alias)
+			changed = true
+		}
+	}
+	if len(known) == 0 {
+		return changed
+	}
+	pkg := checkFiles("", fset, []*ast.File{f}, known...)
+	renamed := map[types.Object]string{}
+	for _, imp := range f.Imports {
+		if pn := pkg.info.Implicits[imp]; pn != nil {
+			if _, ok := r.names[pn.(*types.PkgName).Imported().Path()]; ok {
+				renamed[pn] = pn.Name() + r.suffix
+			}
+		}
+	}
+	for id, obj := range pkg.info.Uses {
+		if n, ok := renamed[obj]; ok {
+			id.Name = n
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPackageSuffix(t *testing.T) {
+	useUpstream(t, "off")
+	for clone, want := range map[string]string{"_two": "_two", "_v1.2": "_v1_2", "": "_goclone_example_com"} {
+		if got := packageSuffix(clone); got != want {
+			t.Errorf("packageSuffix(%q) = %q, want %q", clone, got, want)
+		}
+	}
+}
+
+// renamedModuleFiles are the files of example.com/pn, which imports its own
+// package text and the cloned modules example.com/dep and example.com/go-lib,
+// whose package is named golib.
+var renamedModuleFiles = map[string]string{
+	"go.mod":           "module example.com/pn\n\nrequire (\n\texample.com/dep v1.0.0\n\texample.com/go-lib v1.0.0\n)\n",
+	"text/text.go":     "package text\n\nfunc Hello() string { return \"hello\" }\n",
+	"text/in_test.go":  "package text\n",
+	"text/ext_test.go": "package text_test\n\nimport \"example.com/pn/text\"\n\nvar _ = text.Hello\n",
+	"use/use.go": `package use
+
+import (
+	"example.com/dep"
+	"example.com/go-lib"
+	"example.com/pn/text"
+	t "example.com/pn/text"
+)
+
+func F() string { return text.Hello() + t.Hello() + dep.X + golib.Y }
+
+func G() int {
+	text := 1
+	return text
+}
+`,
+	"cmd/pn/main.go": "package main\n\nimport \"example.com/pn/text\"\n\nfunc main() { println(text.Hello()) }\n",
+}
+
+func TestPackageRenamer(t *testing.T) {
+	zipData := buildZip(t, "example.com/pn@v1.0.0/", renamedModuleFiles)
+	repl := map[string]string{
+		"example.com/pn":     "goclone.example.com/_two/example.com/pn",
+		"example.com/dep":    "goclone.example.com/_two/example.com/dep",
+		"example.com/go-lib": "goclone.example.com/_two/example.com/go-lib",
+	}
+	r, err := newPackageRenamer("example.com/pn", zipData, repl, "_two")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for src, want := range map[string]bool{
+		"package text\n": true,
+		"package x\n\nimport \"example.com/pn/text\"\n": true,
+		"package x\n\nimport \"example.com/dep\"\n":     true,
+		"package x\n\nimport \"example.com/pnx\"\n":     false,
+		"package x\n\nimport \"fmt\"\n":                 false,
+	} {
+		if got := r.mayApply([]byte(src)); got != want {
+			t.Errorf("mayApply(%q) = %v, want %v", src, got, want)
+		}
+	}
+	out, err := rewriteZip(zipData, repl, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"text/text.go":     "package text_two\n\nfunc Hello() string { return \"hello\" }\n",
+		"text/in_test.go":  "package text_two\n",
+		"text/ext_test.go": "package text_two_test\n\nimport \"goclone.example.com/_two/example.com/pn/text\"\n\nvar _ = text_two.Hello\n",
+		"use/use.go": `package use_two
+
+import (
+	dep "goclone.example.com/_two/example.com/dep"
+	golib "goclone.example.com/_two/example.com/go-lib"
+	"goclone.example.com/_two/example.com/pn/text"
+	t "goclone.example.com/_two/example.com/pn/text"
+)
+
+func F() string { return text_two.Hello() + t.Hello() + dep.X + golib.Y }
+
+func G() int {
+	text := 1
+	return text
+}
+`,
+		"cmd/pn/main.go": "package main\n\nimport \"goclone.example.com/_two/example.com/pn/text\"\n\nfunc main() { println(text_two.Hello()) }\n",
+	}
+	for _, f := range zr.File {
+		rel, _ := zipRelPath(f.Name)
+		w, ok := want[rel]
+		if !ok {
+			continue
+		}
+		src, _ := readZipFile(f)
+		if string(src) != w {
+			t.Errorf("%s:\n%s\nwant\n%s", rel, src, w)
+		}
+	}
+}
+
+func TestProxyHandlerRenamePackages(t *testing.T) {
+	zipData := buildZip(t, "example.com/pn@v1.0.0/", renamedModuleFiles)
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example.com/pn/@v/v1.0.0.zip":
+			w.Write(zipData)
+		case "/example.com/pn/@v/v1.0.0.mod":
+			w.Write([]byte(renamedModuleFiles["go.mod"]))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	conf = &config{Clones: []cloneDef{{Name: "_two", RenamePackages: true}}}
+
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_two/example.com/pn/@v/v1.0.0.zip", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if rel, _ := zipRelPath(f.Name); rel == "text/text.go" {
+			src, _ := readZipFile(f)
+			if !bytes.HasPrefix(src, []byte("package text_two\n")) {
+				t.Errorf("package not renamed:\n%s", src)
+			}
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// policy decides which modules may be cloned. Its rules are tried in order
+// and the first one matching a request decides it; requests matching no
+// rule get the default action.
+type policy struct {
+	// Default is "allow" or "deny". It defaults to "allow".
+	Default string       `json:"default"`
+	Rules   []policyRule `json:"rules"`
+	// Licenses refuses to clone modules by their licenses. It applies
+	// whatever the rules say.
+	Licenses *licensePolicy `json:"licenses,omitempty"`
+}
+
+type policyRule struct {
+	// Action is "allow" or "deny".
+	Action string `json:"action"`
+	// Modules is a comma-separated list of upstream module path glob
+	// patterns, matched like GOPRIVATE. Empty matches every module.
+	Modules string `json:"modules,omitempty"`
+	// Clones are glob patterns for clone names, with "" standing for
+	// unprefixed clones. Empty matches every clone.
+	Clones []string `json:"clones,omitempty"`
+	// Versions limits the rule to the versions in a range like
+	// ">=v1.2.0, <v1.4.0". Requests that don't name a version, like
+	// vanity lookups, are for any version: allow rules match them if some
+	// version is in the range, and deny rules, which leave the versions
+	// outside it to later rules, don't.
+	Versions *versionConstraint `json:"versions,omitempty"`
+	// Reason is shown to clients whose request the rule denies.
+	Reason string `json:"reason,omitempty"`
+}
+
+// pol is the loaded policy. The zero policy allows everything.
+var pol = &policy{}
+
+func loadPolicy(file string) (*policy, error) {
+	p := &policy{}
+	if file == "" {
+		return p, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := p.check(); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return p, nil
+}
+
+func (p *policy) check() error {
+	if p.Default != "" && p.Default != "allow" && p.Default != "deny" {
+		return fmt.Errorf("default must be allow or deny, not %q", p.Default)
+	}
+	if p.Licenses != nil {
+		if err := p.Licenses.check(); err != nil {
+			return fmt.Errorf("licenses: %v", err)
+		}
+	}
+	for i, r := range p.Rules {
+		if r.Action != "allow" && r.Action != "deny" {
+			return fmt.Errorf("rules[%d]: action must be allow or deny, not %q", i, r.Action)
+		}
+		for _, pat := range r.Clones {
+			if _, err := path.Match(pat, ""); err != nil {
+				return fmt.Errorf("rules[%d]: bad clone pattern %q", i, pat)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *policyRule) matches(clone, p, version string) bool {
+	if r.Modules != "" && !module.MatchPrefixPatterns(r.Modules, p) {
+		return false
+	}
+	if len(r.Clones) > 0 {
+		ok := false
+		for _, pat := range r.Clones {
+			if m, _ := path.Match(pat, clone); m {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	if r.Versions == nil {
+		return true
+	}
+	if version == "" {
+		return r.Action == "allow" && r.Versions.satisfiable()
+	}
+	return r.Versions.allows(version)
+}
+
+func (r *policyRule) String() string {
+	var parts []string
+	parts = append(parts, r.Action)
+	if r.Modules != "" {
+		parts = append(parts, "modules "+r.Modules)
+	}
+	if len(r.Clones) > 0 {
+		parts = append(parts, fmt.Sprintf("clones %q", r.Clones))
+	}
+	if r.Versions != nil {
+		parts = append(parts, "versions "+r.Versions.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// allow returns a 403 error explaining which rule denies cloning module p
+// at version under the clone name, or nil if that's allowed. version may be
+// empty if the request doesn't name one.
+func (p *policy) allow(clone, modPath, version string) error {
+	what := modPath
+	if clone != "" {
+		what = clone + "/" + modPath
+	}
+	if version != "" {
+		what += "@" + version
+	}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if !r.matches(clone, modPath, version) {
+			continue
+		}
+		if r.Action == "allow" {
+			return nil
+		}
+		msg := fmt.Sprintf("goclone policy rule %d (%s) denies %s", i+1, r, what)
+		if r.Reason != "" {
+			msg += ": " + r.Reason
+		}
+		return &statusError{http.StatusForbidden, errors.New(msg)}
+	}
+	if p.Default == "deny" {
+		return &statusError{http.StatusForbidden, fmt.Errorf("goclone policy denies %s: no rule allows it", what)}
+	}
+	return nil
+}
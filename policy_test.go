@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPolicyAllow(t *testing.T) {
+	p := &policy{}
+	err := json.Unmarshal([]byte(`{
+		"default": "deny",
+		"rules": [
+			{"action": "deny", "modules": "example.com/blocked", "reason": "legal says no"},
+			{"action": "deny", "modules": "example.com/mod", "versions": "<v1.0.1", "reason": "CVE-2023-0001"},
+			{"action": "allow", "modules": "example.com/*", "clones": ["", "_two"]},
+			{"action": "allow", "modules": "other.example/ranged", "versions": ">=v1.2.0"},
+			{"action": "allow", "modules": "other.example/never", "versions": ">v2.0.0, <v1.0.0"}
+		]
+	}`), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.check(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		clone, path, version string
+		want                 string // substring of the error, or "" for allowed
+	}{
+		{"", "example.com/mod", "v1.0.1", ""},
+		{"_two", "example.com/mod/pkg", "", ""},
+		{"", "example.com/mod", "v1.0.0", "rule 2 (deny modules example.com/mod versions <v1.0.1) denies example.com/mod@v1.0.0: CVE-2023-0001"},
+		{"_two", "example.com/blocked", "", "rule 1 (deny modules example.com/blocked) denies _two/example.com/blocked: legal says no"},
+		{"_three", "example.com/mod", "v1.0.1", "no rule allows it"},
+		{"", "other.example/mod", "", "no rule allows it"},
+		{"", "other.example/ranged", "", ""},
+		{"", "other.example/ranged", "v1.1.0", "no rule allows it"},
+		{"", "other.example/never", "", "no rule allows it"},
+	}
+	for _, tt := range tests {
+		err := p.allow(tt.clone, tt.path, tt.version)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s %s@%s: unexpected error %v", tt.clone, tt.path, tt.version, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%s %s@%s: got %v, want %q", tt.clone, tt.path, tt.version, err, tt.want)
+		case err != nil && errorStatus(err) != http.StatusForbidden:
+			t.Errorf("expected 403, got %d", errorStatus(err))
+		}
+	}
+	for _, bad := range []string{`{"default": "maybe"}`, `{"rules": [{"action": "block"}]}`} {
+		p := &policy{}
+		if err := json.Unmarshal([]byte(bad), p); err == nil && p.check() == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+	if err := json.Unmarshal([]byte(`{"rules": [{"action": "deny", "versions": "1.0"}]}`), &policy{}); err == nil {
+		t.Error("expected error for bad version constraint")
+	}
+}
+
+func TestProxyHandlerPolicy(t *testing.T) {
+	serveUpstream(t, newUpstreamHandler(t))
+	defer func(p *policy) { pol = p }(pol)
+	pol = &policy{Rules: []policyRule{{Action: "deny", Modules: "example.com/mod", Versions: mustConstraint(t, "v1.0.0"), Reason: "bad release"}}}
+
+	get := func(rest string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_pol/example.com/mod/@v/"+rest, nil))
+		return w
+	}
+	if w := get("list"); w.Body.String() != "v1.0.1\n" {
+		t.Errorf("list not filtered: %q", w.Body)
+	}
+	for _, rest := range []string{"v1.0.0.info", "v1.0.0.mod", "v1.0.0.zip"} {
+		if w := get(rest); w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "bad release") {
+			t.Errorf("%s: expected 403, got %d: %s", rest, w.Code, w.Body)
+		}
+	}
+	if w := get("v1.0.1.zip"); w.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", w.Code, w.Body)
+	}
+
+	pol = &policy{Rules: []policyRule{{Action: "deny", Clones: []string{"_pol"}}}}
+	w := httptest.NewRecorder()
+	vanityHandler(w, httptest.NewRequest("GET", "/_pol/example.com/mod?go-get=1", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected vanity lookup to be denied, got %d", w.Code)
+	}
+}
+
+func mustConstraint(t *testing.T, s string) *versionConstraint {
+	t.Helper()
+	c, err := parseVersionConstraint(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/token"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Two copies of a module linked into one binary each run their init code,
+// so registrations in global registries collide: database/sql and
+// encoding/gob panic on duplicate names, flag panics on redefined flags,
+// and so on. The scanner here finds such registrations so that users know
+// before linking whether two clones can live in one binary.
+
+// registryCalls are the functions and methods on default registries that
+// register something globally, keyed like "database/sql.Register" or
+// "flag.CommandLine.String", with the index of the argument holding the
+// registered name, or -1 if there is none.
+var registryCalls = func() map[string]int {
+	calls := map[string]int{
+		"database/sql.Register":               0,
+		"encoding/gob.Register":               -1,
+		"encoding/gob.RegisterName":           0,
+		"expvar.Publish":                      0,
+		"expvar.NewFloat":                     0,
+		"expvar.NewInt":                       0,
+		"expvar.NewMap":                       0,
+		"expvar.NewString":                    0,
+		"image.RegisterFormat":                0,
+		"net/http.Handle":                     0,
+		"net/http.HandleFunc":                 0,
+		"net/http.DefaultServeMux.Handle":     0,
+		"net/http.DefaultServeMux.HandleFunc": 0,
+		"github.com/prometheus/client_golang/prometheus.MustRegister":                   -1,
+		"github.com/prometheus/client_golang/prometheus.Register":                       -1,
+		"github.com/prometheus/client_golang/prometheus.DefaultRegisterer.MustRegister": -1,
+		"github.com/prometheus/client_golang/prometheus.DefaultRegisterer.Register":     -1,
+	}
+	// The flag functions define flags on flag.CommandLine, as do its
+	// methods. Those taking a pointer or Value have the name second.
+	for _, name := range []string{"Bool", "Duration", "Float64", "Func", "BoolFunc", "Int", "Int64", "String", "Uint", "Uint64"} {
+		calls["flag."+name] = 0
+		calls["flag.CommandLine."+name] = 0
+	}
+	for _, name := range []string{"BoolVar", "DurationVar", "Float64Var", "IntVar", "Int64Var", "StringVar", "TextVar", "UintVar", "Uint64Var", "Var"} {
+		calls["flag."+name] = 1
+		calls["flag.CommandLine."+name] = 1
+	}
+	for _, kind := range []string{"Counter", "CounterFunc", "CounterVec", "Gauge", "GaugeFunc", "GaugeVec", "Histogram", "HistogramVec", "Summary", "SummaryVec", "UntypedFunc"} {
+		calls["github.com/prometheus/client_golang/prometheus/promauto.New"+kind] = -1
+	}
+	return calls
+}()
+
+// registryImports are the quoted import paths of the registries, to skip
+// parsing files that can't use them.
+var registryImports = func() [][]byte {
+	seen := map[string]bool{}
+	var imps [][]byte
+	for call := range registryCalls {
+		// The import path ends at the first dot after the last slash.
+		i := strings.LastIndex(call, "/") + 1
+		p := call[:i+strings.Index(call[i:], ".")]
+		if !seen[p] {
+			seen[p] = true
+			imps = append(imps, []byte(strconv.Quote(p)))
+		}
+	}
+	return imps
+}()
+
+// registration is a call that registers something globally.
+type registration struct {
+	// File is relative to the module root.
+	File string `json:"file"`
+	Line int    `json:"line"`
+	// Call is the registering function, like "database/sql.Register".
+	Call string `json:"call"`
+	// Name is the registered name, if it is a string literal.
+	Name string `json:"name,omitempty"`
+}
+
+// registrationsReport lists the global registrations in a module.
+type registrationsReport struct {
+	Module        string         `json:"module"`
+	Version       string         `json:"version"`
+	Registrations []registration `json:"registrations"`
+}
+
+var registrationsReports = &byteCache{max: 256}
+
+// registrationsReportFor returns the report for upstreamPath at the escaped
+// version ev, patched with patches. zipData is the patched module zip if the
+// caller already has it.
+func registrationsReportFor(upstreamPath, ev string, patches *patchSet, zipData []byte) (*registrationsReport, error) {
+	rep := &registrationsReport{}
+	err := buildReport(registrationsReports, upstreamPath, ev, patches, zipData, rep, func(modPath, v string, zipData, modData []byte) (err error) {
+		rep.Module, rep.Version = modPath, v
+		rep.Registrations, err = findRegistrations(modPath, zipData)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rep, nil
+}
+
+// findRegistrations returns the global registrations made by the packages
+// in zipData that can be linked into other modules' binaries.
+func findRegistrations(modPath string, zipData []byte) ([]registration, error) {
+	pkgs, err := loadZipPackages(modPath, zipData, linkableDir, usesRegistry)
+	if err != nil {
+		return nil, err
+	}
+	var regs []registration
+	for _, pkg := range pkgs {
+		for _, f := range pkg.files {
+			ast.Inspect(f, func(n ast.Node) bool {
+				call, ok := n.(*ast.CallExpr)
+				if !ok {
+					return true
+				}
+				name, ok := pkg.registryCall(call)
+				if !ok {
+					return true
+				}
+				pos := pkg.fset.Position(call.Pos())
+				file, _ := zipRelPath(pos.Filename)
+				r := registration{File: file, Line: pos.Line, Call: name}
+				if i := registryCalls[name]; i >= 0 && i < len(call.Args) {
+					if lit, ok := call.Args[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+						r.Name, _ = strconv.Unquote(lit.Value)
+					}
+				}
+				regs = append(regs, r)
+				return true
+			})
+		}
+	}
+	sort.SliceStable(regs, func(i, j int) bool {
+		if regs[i].File != regs[j].File {
+			return regs[i].File < regs[j].File
+		}
+		return regs[i].Line < regs[j].Line
+	})
+	return regs, nil
+}
+
+// registryCall returns the registering function that call calls, if any.
+func (p *zipPackage) registryCall(call *ast.CallExpr) (string, bool) {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return "", false
+	}
+	name := ""
+	if imp, ok := p.qualifier(sel); ok {
+		name = imp + "." + sel.Sel.Name
+	} else if inner, ok := sel.X.(*ast.SelectorExpr); ok {
+		// A method on a default registry, like flag.CommandLine.String.
+		imp, ok := p.qualifier(inner)
+		if !ok {
+			return "", false
+		}
+		name = imp + "." + inner.Sel.Name + "." + sel.Sel.Name
+	}
+	_, ok = registryCalls[name]
+	return name, ok
+}
+
+// linkableDir reports whether a package in dir, relative to the module
+// root, can be linked into another module's binary.
+func linkableDir(dir string) bool {
+	if dir == "." {
+		return true
+	}
+	for _, elem := range strings.Split(dir, "/") {
+		if elem == "testdata" || elem == "vendor" || strings.HasPrefix(elem, "_") || strings.HasPrefix(elem, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// usesRegistry reports whether src may import one of the registries.
+func usesRegistry(src []byte) bool {
+	for _, imp := range registryImports {
+		if bytes.Contains(src, imp) {
+			return true
+		}
+	}
+	return false
+}
+
+// warnRegistrations adds a warning to the response header of the zip of
+// upstreamPath at the escaped version ev, patched with patches and served as
+// userPath, if the module makes global registrations. The warning is
+// advisory, so a module that can't be scanned is served without it.
+func warnRegistrations(header http.Header, userPath, upstreamPath, ev string, patches *patchSet, zipData []byte) http.Header {
+	rep, err := registrationsReportFor(upstreamPath, ev, patches, zipData)
+	if err != nil {
+		log.Printf("scanning %s@%s for registrations: %v", upstreamPath, ev, err)
+		return header
+	}
+	if len(rep.Registrations) == 0 {
+		return header
+	}
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("X-Goclone-Warning", fmt.Sprintf("%s makes %d global registrations that may collide with other copies; see /_report/registrations/%s/%s@%s", rep.Module, len(rep.Registrations), *host, userPath, ev))
+	return header
+}
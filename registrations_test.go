@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func buildRegisteringModule(t *testing.T) (mod, zipData []byte) {
+	t.Helper()
+	mod = []byte("module example.com/reg\n\ngo 1.21\n")
+	return mod, buildZip(t, "example.com/reg@v1.0.0/", map[string]string{
+		"go.mod": string(mod),
+		"driver.go": `package reg
+
+import (
+	stdsql "database/sql"
+	"encoding/gob"
+	"flag"
+	"net/http"
+)
+
+var verbose = flag.Bool("verbose", false, "")
+
+func init() {
+	stdsql.Register("regdb", nil)
+	gob.Register(T{})
+	flag.CommandLine.StringVar(&name, "name", "", "")
+	http.DefaultServeMux.HandleFunc("/debug/reg", nil)
+}
+
+type T struct{}
+
+var name string
+`,
+		"shadow.go": `package reg
+
+import "database/sql"
+
+func local() {
+	sql := struct{ Register func(string) }{}
+	sql.Register("not a registration")
+}
+`,
+		"metrics/metrics.go": `package metrics
+
+import (
+	"expvar"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var Hits = expvar.NewInt("hits")
+var Reqs = promauto.NewCounter(prometheus.CounterOpts{})
+`,
+		"nothing/nothing.go":    "package nothing\n\nfunc Register(string) {}\n",
+		"cmd/tool/main.go":      "package main\n\nimport \"flag\"\n\nvar x = flag.Int(\"x\", 0, \"\")\n",
+		"testdata/t.go":         "package t\n\nimport \"flag\"\n\nvar x = flag.Int(\"x\", 0, \"\")\n",
+		"reg_test.go":           "package reg\n\nimport \"flag\"\n\nvar x = flag.Int(\"x\", 0, \"\")\n",
+		"internal/hook/hook.go": "package hook\n\nimport \"image\"\n\nfunc init() { image.RegisterFormat(\"reg\", \"REG\", nil, nil) }\n",
+	})
+}
+
+func TestFindRegistrations(t *testing.T) {
+	_, zipData := buildRegisteringModule(t)
+	regs, err := findRegistrations("example.com/reg", zipData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []registration{
+		{File: "driver.go", Line: 10, Call: "flag.Bool", Name: "verbose"},
+		{File: "driver.go", Line: 13, Call: "database/sql.Register", Name: "regdb"},
+		{File: "driver.go", Line: 14, Call: "encoding/gob.Register"},
+		{File: "driver.go", Line: 15, Call: "flag.CommandLine.StringVar", Name: "name"},
+		{File: "driver.go", Line: 16, Call: "net/http.DefaultServeMux.HandleFunc", Name: "/debug/reg"},
+		{File: "internal/hook/hook.go", Line: 5, Call: "image.RegisterFormat", Name: "reg"},
+		{File: "metrics/metrics.go", Line: 10, Call: "expvar.NewInt", Name: "hits"},
+		{File: "metrics/metrics.go", Line: 11, Call: "github.com/prometheus/client_golang/prometheus/promauto.NewCounter"},
+	}
+	if !reflect.DeepEqual(regs, want) {
+		t.Errorf("got %+v\nwant %+v", regs, want)
+	}
+}
+
+func TestProxyHandlerRegistrationsWarning(t *testing.T) {
+	mod, zipData := buildRegisteringModule(t)
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example.com/reg/@v/v1.0.0.mod":
+			w.Write(mod)
+		case "/example.com/reg/@v/v1.0.0.zip":
+			w.Write(zipData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	conf = &config{Clones: []cloneDef{{Name: "_two", WarnRegistrations: true}}}
+
+	// Clones that don't ask for the warning aren't scanned.
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_quiet/example.com/reg/@v/v1.0.0.zip", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Goclone-Warning") != "" {
+		t.Errorf("clone without warnings: %d %q", w.Code, w.Header().Get("X-Goclone-Warning"))
+	}
+
+	w = httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_two/example.com/reg/@v/v1.0.0.zip", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	warning := w.Header().Get("X-Goclone-Warning")
+	if !strings.Contains(warning, "8 global registrations") || !strings.Contains(warning, "/_report/registrations/goclone.example.com/_two/example.com/reg@v1.0.0") {
+		t.Errorf("unexpected warning %q", warning)
+	}
+
+	w = httptest.NewRecorder()
+	reportHandler(w, httptest.NewRequest("GET", "/_report/registrations/goclone.example.com/_two/example.com/reg@v1.0.0", nil))
+	var rep registrationsReport
+	if err := json.Unmarshal(w.Body.Bytes(), &rep); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	if len(rep.Registrations) != 8 {
+		t.Errorf("unexpected report %+v", rep)
+	}
+}
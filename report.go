@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/mod/module"
+)
+
+// buildReport fills in rep, a pointer to a report, for upstreamPath at the
+// escaped version ev with the before-patches of patches applied. The report
+// comes from cache if it is there, and otherwise from analyze, which is
+// given the module zip and its go.mod. The zip is fetched and patched
+// unless the caller already has the patched zip in zipData.
+func buildReport(cache *byteCache, upstreamPath, ev string, patches *patchSet, zipData []byte, rep any, analyze func(modPath, v string, zipData, modData []byte) error) error {
+	key := upstreamPath + "@" + ev
+	if k := patches.key(); k != "" {
+		key += "+" + k
+	}
+	if b, ok := cache.get(key); ok {
+		return json.Unmarshal(b, rep)
+	}
+	modPath, err := unescapeModPath(upstreamPath)
+	if err != nil {
+		return notFound("%v", err)
+	}
+	v, err := module.UnescapeVersion(ev)
+	if err != nil {
+		return notFound("%v", err)
+	}
+	if zipData == nil {
+		a, err := fetchUpstream(upstreamPath, ev+".zip")
+		if err != nil {
+			return err
+		}
+		if a.status != http.StatusOK {
+			return &statusError{a.status, fmt.Errorf("%s@%s: upstream returned %d", modPath, v, a.status)}
+		}
+		zipData = a.body
+		if patches != nil {
+			if zipData, err = patchZip(zipData, patches.before, nil); err != nil {
+				return patchError(modPath, v, err)
+			}
+		}
+	}
+	modData, ok := upstreamMods.get(key)
+	if !ok {
+		if modData, err = extractGoModFromZip(zipData); err != nil {
+			return &statusError{http.StatusBadGateway, err}
+		}
+	}
+	if err := analyze(modPath, v, zipData, modData); err != nil {
+		return err
+	}
+	b, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	cache.put(key, b)
+	return nil
+}
+
+// reportHandler serves analyses of modules at paths like
+// /_report/deps/_two/example.com/mod@v1.2.3, with the module path and
+// version escaped as in proxy requests.
+func reportHandler(w http.ResponseWriter, r *http.Request) {
+	kind, trimmed, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/_report/"), "/")
+	trimmed = strings.TrimPrefix(trimmed, *host+"/")
+	i := strings.LastIndex(trimmed, "@")
+	if i < 0 || kind != "deps" && kind != "registrations" && kind != "cgo" && kind != "license" {
+		http.NotFound(w, r)
+		return
+	}
+	userPath, ev := trimmed[:i], trimmed[i+1:]
+	if err := authorize(r, userPath); err != nil {
+		writeError(w, err)
+		return
+	}
+	clone, upstreamPath := splitClonePath(userPath)
+	modPath, err := unescapeModPath(upstreamPath)
+	if err != nil {
+		writeError(w, notFound("%v", err))
+		return
+	}
+	v, err := module.UnescapeVersion(ev)
+	if err != nil {
+		writeError(w, notFound("%v", err))
+		return
+	}
+	def := cloneDefFor(clone, modPath)
+	if err := def.allowVersion(modPath, v); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := def.allowSourceVersion(modPath, v); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := pol.allow(clone, modPath, v); err != nil {
+		writeError(w, err)
+		return
+	}
+	fetchPath := def.fetchPath(modPath, upstreamPath)
+	// The reports are of the code as the clone serves it.
+	patches := def.patchesFor(modPath, v)
+	var rep any
+	switch kind {
+	case "deps":
+		rep, err = depsReportFor(fetchPath, ev, patches, nil)
+	case "registrations":
+		rep, err = registrationsReportFor(fetchPath, ev, patches, nil)
+	case "cgo":
+		rep, err = cgoReportFor(fetchPath, ev, patches, nil)
+	case "license":
+		rep, err = licenseReportFor(fetchPath, ev, patches, nil)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	b, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(append(b, '\n'))
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// A slim clone leaves out of its zips the classes of files that only matter
+// to the module's own development, since clones are only built into
+// binaries. License files and go.mod are always kept, and so are the
+// packages the remaining Go files import and anything they embed.
+
+// slimClasses maps the name of each class of files a slim clone may drop to
+// whether it holds a file, by its path relative to the module root.
+var slimClasses = map[string]func(rel string) bool{
+	"tests": func(rel string) bool {
+		return strings.HasSuffix(rel, "_test.go")
+	},
+	"testdata": func(rel string) bool {
+		return hasDirElem(rel, "testdata")
+	},
+	"examples": func(rel string) bool {
+		base := path.Base(rel)
+		return base == "example_test.go" || strings.HasPrefix(base, "example_") && strings.HasSuffix(base, "_test.go") ||
+			hasDirElem(rel, "example", "examples", "_example", "_examples")
+	},
+	"docs": func(rel string) bool {
+		return docExts[path.Ext(rel)] && hasDirElem(rel, "doc", "docs")
+	},
+}
+
+// docExts are the extensions of documentation files, which the docs class
+// drops. Others, like assembly and C files, may be part of a package.
+var docExts = map[string]bool{
+	".md": true, ".markdown": true, ".rst": true, ".txt": true, ".adoc": true, ".org": true,
+	".html": true, ".htm": true, ".pdf": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true,
+}
+
+// hasDirElem reports whether any directory in rel is named one of names.
+func hasDirElem(rel string, names ...string) bool {
+	elems := strings.Split(path.Dir(rel), "/")
+	for _, e := range elems {
+		for _, n := range names {
+			if e == n {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkSlim(classes []string) error {
+	for _, c := range classes {
+		if slimClasses[c] == nil {
+			return fmt.Errorf("unknown slim class %q", c)
+		}
+	}
+	return nil
+}
+
+// slimZip returns the zip data without the files in classes.
+func slimZip(data []byte, classes []string) ([]byte, error) {
+	if len(classes) == 0 {
+		return data, nil
+	}
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, &statusError{http.StatusBadGateway, err}
+	}
+	drop := map[*zip.File]bool{}
+	var rels []string
+	for _, f := range r.File {
+		rel, ok := zipRelPath(f.Name)
+		if !ok {
+			continue
+		}
+		rels = append(rels, rel)
+		if rel == "go.mod" || isLicenseFile(rel) {
+			continue
+		}
+		for _, c := range classes {
+			if slimClasses[c](rel) {
+				drop[f] = true
+				break
+			}
+		}
+	}
+	if len(drop) == 0 {
+		return data, nil
+	}
+
+	// Packages imported by the Go files that remain stay too, as for
+	// examples whose code the module uses, and so do the packages those
+	// import. Their tests may still go.
+	modPath := ""
+	dropped := map[string][]*zip.File{}
+	var queue []*zip.File
+	for _, f := range r.File {
+		rel, ok := zipRelPath(f.Name)
+		switch {
+		case !ok:
+		case rel == "go.mod":
+			if src, err := readZipFile(f); err == nil {
+				modPath = modfile.ModulePath(src)
+			}
+		case drop[f]:
+			if !strings.HasSuffix(rel, "_test.go") {
+				dropped[path.Dir(rel)] = append(dropped[path.Dir(rel)], f)
+			}
+		case strings.HasSuffix(rel, ".go"):
+			queue = append(queue, f)
+		}
+	}
+	for len(queue) > 0 && modPath != "" {
+		f := queue[0]
+		queue = queue[1:]
+		src, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range goImports(src) {
+			dir, ok := ".", ip == modPath
+			if !ok {
+				dir, ok = strings.CutPrefix(ip, modPath+"/")
+			}
+			if !ok {
+				continue
+			}
+			for _, df := range dropped[dir] {
+				delete(drop, df)
+				if strings.HasSuffix(df.Name, ".go") {
+					queue = append(queue, df)
+				}
+			}
+			delete(dropped, dir)
+		}
+	}
+
+	// Files embedded by the Go files that remain stay too.
+	var embeds []string
+	for _, f := range r.File {
+		rel, ok := zipRelPath(f.Name)
+		if !ok || drop[f] || !strings.HasSuffix(rel, ".go") {
+			continue
+		}
+		src, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Contains(src, []byte("//go:embed")) {
+			continue
+		}
+		for _, p := range embedPatterns(src) {
+			embeds = append(embeds, path.Join(path.Dir(rel), p))
+		}
+	}
+	for _, f := range r.File {
+		if !drop[f] {
+			continue
+		}
+		rel, _ := zipRelPath(f.Name)
+		if embedded(rel, embeds) {
+			delete(drop, f)
+		}
+	}
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, f := range r.File {
+		if drop[f] {
+			continue
+		}
+		if err := copyZipFile(w, f, f.Name); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// goImports returns the import paths of the Go source src.
+func goImports(src []byte) []string {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.ImportsOnly)
+	if err != nil {
+		return nil
+	}
+	var paths []string
+	for _, imp := range f.Imports {
+		if p, err := strconv.Unquote(imp.Path.Value); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// embedPatterns returns the patterns of the //go:embed directives in the Go
+// source src, without any "all:" prefixes.
+func embedPatterns(src []byte) []string {
+	f, err := parser.ParseFile(token.NewFileSet(), "", src, parser.ParseComments)
+	if err != nil {
+		return nil
+	}
+	var patterns []string
+	for _, cg := range f.Comments {
+		for _, c := range cg.List {
+			args, ok := strings.CutPrefix(c.Text, "//go:embed")
+			if !ok || args != "" && args[0] != ' ' && args[0] != '\t' {
+				continue
+			}
+			for _, p := range splitEmbedArgs(args) {
+				patterns = append(patterns, strings.TrimPrefix(p, "all:"))
+			}
+		}
+	}
+	return patterns
+}
+
+// splitEmbedArgs splits the arguments of a //go:embed directive, which may
+// be quoted Go strings.
+func splitEmbedArgs(args string) []string {
+	var out []string
+	for {
+		args = strings.TrimLeft(args, " \t")
+		if args == "" {
+			return out
+		}
+		var arg string
+		switch args[0] {
+		case '"', '`':
+			q, err := strconv.QuotedPrefix(args)
+			if err != nil {
+				return out
+			}
+			args = args[len(q):]
+			arg, _ = strconv.Unquote(q)
+		default:
+			i := strings.IndexAny(args, " \t")
+			if i < 0 {
+				i = len(args)
+			}
+			arg, args = args[:i], args[i:]
+		}
+		out = append(out, arg)
+	}
+}
+
+// embedded reports whether one of patterns matches the file rel or one of
+// its directories, which embeds the whole directory.
+func embedded(rel string, patterns []string) bool {
+	for _, p := range patterns {
+		for name := rel; name != "."; name = path.Dir(name) {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
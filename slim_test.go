@@ -0,0 +1,117 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestEmbedPatterns(t *testing.T) {
+	src := "package p\n\nimport _ \"embed\"\n\n//go:embed a.txt  static/*.css\n//go:embed \"with space.txt\" `raw` all:hidden\nvar s string\n\n//go:embedded not a directive\nvar t string\n"
+	got := embedPatterns([]byte(src))
+	want := []string{"a.txt", "static/*.css", "with space.txt", "raw", "hidden"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func slimmedFiles(t *testing.T, data []byte) []string {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		rel, _ := zipRelPath(f.Name)
+		names = append(names, rel)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSlimZip(t *testing.T) {
+	zipData := buildZip(t, "example.com/m@v1.0.0/", map[string]string{
+		"go.mod":                      "module example.com/m\n",
+		"LICENSE":                     "license\n",
+		"m.go":                        "package m\n\nimport \"embed\"\n\n//go:embed testdata/golden.txt docs\nvar fs embed.FS\n",
+		"m_test.go":                   "package m\n",
+		"example_test.go":             "package m_test\n",
+		"testdata/golden.txt":         "golden\n",
+		"testdata/input.txt":          "input\n",
+		"docs/guide.md":               "guide\n",
+		"doc/old.md":                  "old\n",
+		"doc/LICENSE.third_party":     "third party\n",
+		"examples/hello/main.go":      "package main\n",
+		"sub/sub.go":                  "package sub\n",
+		"sub/example_hello_test.go":   "package sub_test\n",
+		"sub/testdata/x.txt":          "x\n",
+		"doc/asm.s":                   "#include \"textflag.h\"\n",
+		"doc/diagram.png":             "png\n",
+		"uses.go":                     "package m\n\nimport _ \"example.com/m/examples/shared\"\n",
+		"examples/shared/shared.go":   "package shared\n\nimport _ \"example.com/m/examples/shared/deeper\"\n",
+		"examples/shared/shared.s":    "#include \"textflag.h\"\n",
+		"examples/shared/x_test.go":   "package shared\n",
+		"examples/shared/deeper/d.go": "package deeper\n",
+	})
+	out, err := slimZip(zipData, []string{"tests", "testdata", "examples", "docs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := slimmedFiles(t, out)
+	want := []string{"LICENSE", "doc/LICENSE.third_party", "doc/asm.s", "docs/guide.md", "examples/shared/deeper/d.go", "examples/shared/shared.go", "examples/shared/shared.s", "go.mod", "m.go", "sub/sub.go", "testdata/golden.txt", "uses.go"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	out, err = slimZip(zipData, []string{"examples"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rel := range slimmedFiles(t, out) {
+		if strings.Contains(rel, "example") && !strings.HasPrefix(rel, "examples/shared/") {
+			t.Errorf("kept %s", rel)
+		}
+	}
+	if out, _ := slimZip(zipData, nil); !bytes.Equal(out, zipData) {
+		t.Errorf("no classes changed the zip")
+	}
+}
+
+func TestProxyHandlerSlim(t *testing.T) {
+	zipData := buildZip(t, "example.com/slimmed@v1.0.0/", map[string]string{
+		"go.mod":              "module example.com/slimmed\n",
+		"a.go":                "package slimmed\n",
+		"a_test.go":           "package slimmed\n",
+		"testdata/input.json": "{}\n",
+	})
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example.com/slimmed/@v/v1.0.0.mod":
+			fmt.Fprint(w, "module example.com/slimmed\n")
+		case "/example.com/slimmed/@v/v1.0.0.zip":
+			w.Write(zipData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	conf = &config{Clones: []cloneDef{{Name: "_slim", Slim: []string{"tests", "testdata"}}}}
+
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_slim/example.com/slimmed/@v/v1.0.0.zip", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("zip: %d %s", w.Code, w.Body)
+	}
+	if got := slimmedFiles(t, w.Body.Bytes()); fmt.Sprint(got) != "[a.go go.mod]" {
+		t.Errorf("got %v", got)
+	}
+
+	if err := (&cloneDef{Name: "_slim", Slim: []string{"benchmarks"}}).check(); err == nil {
+		t.Errorf("unknown slim class accepted")
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// A standard library clone serves a package from a Go release as a module
+// whose path is "std/" and the import path, like "std/encoding/json", under
+// a clone such as _go1.21. The module has a version for each release, v1.21.5
+// for go1.21.5, and its source comes from the golang.org/toolchain module
+// on the upstream. The package itself is at the root of the module. Other
+// standard packages it imports stay as they are, except internal and
+// vendored ones, which can't be imported from outside the standard library
+// and so move under internal/goclone. Packages that are tied to the runtime
+// by assembly, linknames or cgo can't be moved and aren't served.
+
+// stdPrefix starts the module paths of standard library clones.
+const stdPrefix = "std/"
+
+// toolchainModule is the module that Go releases are published as. Its
+// versions are like v0.0.1-go1.21.5.linux-amd64.
+const toolchainModule = "golang.org/toolchain"
+
+// toolchainPlatform is the platform whose releases the source is taken from.
+// The source is the same for every platform.
+const toolchainPlatform = "linux-amd64"
+
+// toolchainZips holds recently fetched toolchain zips, keyed by version, as
+// each serves many packages.
+var toolchainZips = &byteCache{max: 2}
+
+// unescapeModPath is module.UnescapePath, but also accepts the paths of
+// standard library clones, which don't start with a domain name.
+func unescapeModPath(p string) (string, error) {
+	if pkg, ok := strings.CutPrefix(p, stdPrefix); ok {
+		if err := module.CheckImportPath(pkg); err != nil {
+			return "", err
+		}
+		return p, nil
+	}
+	return module.UnescapePath(p)
+}
+
+// goReleaseRE matches Go release names like go1.21.5, go1.20 and go1.21rc2.
+var goReleaseRE = regexp.MustCompile(`^go1\.(\d+)(?:\.(\d+))?(?:(beta|rc)(\d+))?$`)
+
+// stdVersion returns the module version for the Go release named goVersion.
+func stdVersion(goVersion string) (string, bool) {
+	m := goReleaseRE.FindStringSubmatch(goVersion)
+	if m == nil {
+		return "", false
+	}
+	patch := m[2]
+	if patch == "" {
+		patch = "0"
+	}
+	v := "v1." + m[1] + "." + patch
+	if m[3] != "" {
+		v += "-" + m[3] + "." + m[4]
+	}
+	return v, true
+}
+
+// goRelease returns the name of the Go release with the module version v.
+func goRelease(v string) (string, bool) {
+	if !semver.IsValid(v) || semver.Major(v) != "v1" || semver.Build(v) != "" {
+		return "", false
+	}
+	minorPatch := strings.TrimPrefix(strings.TrimSuffix(v, semver.Prerelease(v)), "v1.")
+	minor, patch, _ := strings.Cut(minorPatch, ".")
+	n, _ := strconv.Atoi(minor)
+	name := "go1." + minor
+	// Before Go 1.21, first releases had no patch number.
+	if patch != "0" || n >= 21 && semver.Prerelease(v) == "" {
+		name += "." + patch
+	}
+	if pre := semver.Prerelease(v); pre != "" {
+		kind, num, ok := strings.Cut(strings.TrimPrefix(pre, "-"), ".")
+		if !ok || kind != "beta" && kind != "rc" {
+			return "", false
+		}
+		name += kind + num
+	}
+	if back, ok := stdVersion(name); !ok || back != v {
+		return "", false
+	}
+	return name, true
+}
+
+// toolchainVersion returns the version of golang.org/toolchain holding the
+// Go release named goVersion.
+func toolchainVersion(goVersion string) string {
+	return "v0.0.1-" + goVersion + "." + toolchainPlatform
+}
+
+// stdSource serves standard library clones.
+type stdSource struct {
+	// path is the module path, like "std/encoding/json".
+	path string
+}
+
+func (s *stdSource) String() string { return toolchainModule }
+
+func (s *stdSource) fetch(escPath, rest string) (*artifact, error) {
+	switch rest {
+	case "list":
+		a, err := fetchUpstream(toolchainModule, "list")
+		if err != nil || a.status != http.StatusOK {
+			return a, err
+		}
+		var vers []string
+		for _, tv := range strings.Fields(string(a.body)) {
+			goVersion, ok := strings.CutSuffix(strings.TrimPrefix(tv, "v0.0.1-"), "."+toolchainPlatform)
+			if v, vok := stdVersion(goVersion); ok && vok {
+				vers = append(vers, v)
+			}
+		}
+		semver.Sort(vers)
+		return &artifact{status: http.StatusOK, header: a.header, body: []byte(strings.Join(vers, "\n") + "\n")}, nil
+	case "@latest":
+		a, err := s.fetch(escPath, "list")
+		if err != nil || a.status != http.StatusOK {
+			return a, err
+		}
+		latest := ""
+		for _, v := range strings.Fields(string(a.body)) {
+			if semver.Prerelease(v) == "" {
+				latest = v
+			}
+		}
+		if latest == "" {
+			return nil, notFound("%s: no Go releases", s.path)
+		}
+		return s.fetch(escPath, latest+".info")
+	}
+	i := strings.LastIndex(rest, ".")
+	if i < 0 {
+		return nil, notFound("%s: unknown file %s", s.path, rest)
+	}
+	ev, ext := rest[:i], rest[i+1:]
+	v, err := module.UnescapeVersion(ev)
+	if err != nil {
+		return nil, notFound("%v", err)
+	}
+	goVersion, ok := goRelease(v)
+	if !ok {
+		return nil, notFound("%s@%s: not a Go release", s.path, v)
+	}
+	tv := toolchainVersion(goVersion)
+	switch ext {
+	case "info":
+		a, err := fetchUpstream(toolchainModule, tv+".info")
+		if err != nil || a.status != http.StatusOK {
+			return a, err
+		}
+		var info struct{ Time time.Time }
+		if err := json.Unmarshal(a.body, &info); err != nil {
+			return nil, &statusError{http.StatusBadGateway, fmt.Errorf("%s@%s: %v", toolchainModule, tv, err)}
+		}
+		body, err := json.Marshal(struct {
+			Version string
+			Time    time.Time
+		}{v, info.Time})
+		if err != nil {
+			return nil, err
+		}
+		return &artifact{status: http.StatusOK, header: a.header, body: body}, nil
+	case "mod":
+		a, err := fetchUpstream(toolchainModule, tv+".mod")
+		if err != nil || a.status != http.StatusOK {
+			return a, err
+		}
+		return &artifact{status: http.StatusOK, header: a.header, body: stdGoMod(s.path, v)}, nil
+	case "zip":
+		zipData, ok := toolchainZips.get(tv)
+		header := http.Header{}
+		if !ok {
+			a, err := fetchUpstream(toolchainModule, tv+".zip")
+			if err != nil || a.status != http.StatusOK {
+				return a, err
+			}
+			zipData, header = a.body, a.header
+			toolchainZips.put(tv, zipData)
+		}
+		body, err := stdZip(s.path, v, zipData)
+		if err != nil {
+			return nil, err
+		}
+		return &artifact{status: http.StatusOK, header: header, body: body}, nil
+	}
+	return nil, notFound("%s: unknown file %s", s.path, rest)
+}
+
+// stdGoMod returns the go.mod of the standard library clone modPath at
+// version v.
+func stdGoMod(modPath, v string) []byte {
+	return []byte(fmt.Sprintf("module %s\n\ngo %s\n", modPath, strings.TrimPrefix(semver.MajorMinor(v), "v")))
+}
+
+// stdZip returns the zip of the standard library clone modPath at version v,
+// made from zipData, the toolchain zip of the release.
+func stdZip(modPath, v string, zipData []byte) ([]byte, error) {
+	pkg := strings.TrimPrefix(modPath, stdPrefix)
+	if !isPublicStd(pkg) {
+		return nil, notFound("%s: only public standard library packages can be cloned", pkg)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, &statusError{http.StatusBadGateway, err}
+	}
+	// dirs holds the files in each directory under src, less tests.
+	dirs := map[string][]*zip.File{}
+	var licenses []*zip.File
+	for _, f := range zr.File {
+		rel, ok := zipRelPath(f.Name)
+		if !ok {
+			continue
+		}
+		if path.Dir(rel) == "." && isLicenseFile(rel) {
+			licenses = append(licenses, f)
+		}
+		if rel, ok = strings.CutPrefix(rel, "src/"); ok && !strings.HasSuffix(rel, "_test.go") {
+			dirs[path.Dir(rel)] = append(dirs[path.Dir(rel)], f)
+		}
+	}
+	if dirs[pkg] == nil {
+		return nil, notFound("%s: no package %s in go%s", modPath, pkg, strings.TrimPrefix(v, "v"))
+	}
+
+	// moved maps the import path of each internal or vendored package the
+	// package needs to its new directory.
+	moved := map[string]string{}
+	var problems []string
+	queue := []string{pkg}
+	for len(queue) > 0 {
+		ip := queue[0]
+		queue = queue[1:]
+		for _, f := range dirs[stdDir(ip)] {
+			name := path.Base(f.Name)
+			if strings.HasSuffix(name, ".s") {
+				problems = append(problems, fmt.Sprintf("%s: assembly in %s", ip, name))
+				continue
+			}
+			if !strings.HasSuffix(name, ".go") {
+				continue
+			}
+			src, err := readZipFile(f)
+			if err != nil {
+				return nil, err
+			}
+			af, err := parser.ParseFile(token.NewFileSet(), name, src, parser.ImportsOnly|parser.ParseComments)
+			if err != nil || ignoredFile(af) {
+				continue
+			}
+			for _, directive := range []string{"//go:linkname", "//go:noescape"} {
+				if bytes.Contains(src, []byte(directive)) {
+					problems = append(problems, fmt.Sprintf("%s: %s in %s", ip, directive, name))
+				}
+			}
+			for _, imp := range af.Imports {
+				dep, _ := strconv.Unquote(imp.Path.Value)
+				switch {
+				case dep == "C":
+					problems = append(problems, fmt.Sprintf("%s: cgo in %s", ip, name))
+				case strings.HasPrefix(dep, "runtime/internal/") || strings.HasPrefix(dep, "internal/runtime/"):
+					problems = append(problems, fmt.Sprintf("%s: imports %s", ip, dep))
+				case isPublicStd(dep):
+				default:
+					if _, ok := moved[dep]; !ok && dirs[stdDir(dep)] != nil {
+						moved[dep] = subtreeMovedDir(stdDir(dep))
+						queue = append(queue, dep)
+					}
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, &statusError{http.StatusUnprocessableEntity, fmt.Errorf("%s@%s can't be moved out of the standard library:\n\t%s", modPath, v, strings.Join(slices.Compact(problems), "\n\t"))}
+	}
+
+	repl := map[string]string{}
+	for ip, nd := range moved {
+		repl[ip] = modPath + "/" + nd
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	root := modPath + "@" + v + "/"
+	write := func(name string, b []byte) error {
+		fw, err := zw.Create(root + name)
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(b)
+		return err
+	}
+	if err := write("go.mod", stdGoMod(modPath, v)); err != nil {
+		return nil, err
+	}
+	for _, f := range licenses {
+		b, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if err := write(path.Base(f.Name), b); err != nil {
+			return nil, err
+		}
+	}
+	newDirs := map[string]string{stdDir(pkg): ""}
+	for ip, nd := range moved {
+		newDirs[stdDir(ip)] = nd + "/"
+	}
+	var names []string
+	for d := range newDirs {
+		names = append(names, d)
+	}
+	sort.Strings(names)
+	for _, d := range names {
+		for _, f := range dirs[d] {
+			b, err := readZipFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasSuffix(f.Name, ".go") {
+				if b, err = rewriteGoFile(f.Name, b, repl, nil); err != nil {
+					return nil, &statusError{http.StatusUnprocessableEntity, fmt.Errorf("%s: %v", f.Name, err)}
+				}
+			}
+			if err := write(newDirs[d]+path.Base(f.Name), b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// stdDir returns the directory under src of the standard library package
+// with the import path ip. Packages outside the standard library are
+// vendored ones.
+func stdDir(ip string) string {
+	if elem, _, _ := strings.Cut(ip, "/"); strings.Contains(elem, ".") {
+		return "vendor/" + ip
+	}
+	return ip
+}
+
+// isPublicStd reports whether ip is a standard library package that any
+// package may import.
+func isPublicStd(ip string) bool {
+	elem, _, _ := strings.Cut(ip, "/")
+	if strings.Contains(elem, ".") || elem == "cmd" || elem == "vendor" {
+		return false
+	}
+	for _, e := range strings.Split(ip, "/") {
+		if e == "internal" {
+			return false
+		}
+	}
+	return true
+}
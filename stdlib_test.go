@@ -0,0 +1,155 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestStdVersion(t *testing.T) {
+	for _, tt := range []struct{ goVersion, v string }{
+		{"go1.21.0", "v1.21.0"},
+		{"go1.21.5", "v1.21.5"},
+		{"go1.20", "v1.20.0"},
+		{"go1.20.3", "v1.20.3"},
+		{"go1.21rc2", "v1.21.0-rc.2"},
+		{"go1.22beta1", "v1.22.0-beta.1"},
+	} {
+		if v, ok := stdVersion(tt.goVersion); !ok || v != tt.v {
+			t.Errorf("stdVersion(%q) = %q, %v, want %q", tt.goVersion, v, ok, tt.v)
+		}
+		if g, ok := goRelease(tt.v); !ok || g != tt.goVersion {
+			t.Errorf("goRelease(%q) = %q, %v, want %q", tt.v, g, ok, tt.goVersion)
+		}
+	}
+	for _, v := range []string{"v2.0.0", "v1.21.0-alpha.1", "v1.21.0-0.20230101000000-abcdefabcdef", "v1.21.0+build"} {
+		if g, ok := goRelease(v); ok {
+			t.Errorf("goRelease(%q) = %q, want failure", v, g)
+		}
+	}
+	if _, ok := stdVersion("go1.21.0.linux-amd64"); ok {
+		t.Errorf("stdVersion accepted a toolchain platform suffix")
+	}
+}
+
+// toolchainFiles are the files of a fake Go release.
+var toolchainFiles = map[string]string{
+	"LICENSE":                        "license\n",
+	"PATENTS":                        "patents\n",
+	"VERSION":                        "go1.21.0\n",
+	"src/encoding/json/json.go":      "package json\n\nimport (\n\t\"bytes\"\n\t\"internal/fmtsort\"\n\n\t\"golang.org/x/text/unicode/norm\"\n)\n\nvar _, _, _ = bytes.Equal, fmtsort.Sort, norm.NFC\n",
+	"src/encoding/json/json_test.go": "package json\n\nimport \"internal/testenv\"\n",
+	"src/internal/fmtsort/sort.go":   "package fmtsort\n\nimport \"reflect\"\n\nfunc Sort(reflect.Value) {}\n",
+	"src/vendor/golang.org/x/text/unicode/norm/norm.go": "package norm\n\nconst NFC = 0\n",
+	"src/crypto/fast/fast.go":                           "package fast\n\nfunc add(a, b int) int\n",
+	"src/crypto/fast/fast_amd64.s":                      "TEXT ·add(SB),0,$0\n",
+	"src/os/sig/sig.go":                                 "package sig\n\nimport _ \"unsafe\"\n\n//go:linkname notify runtime.notify\nfunc notify()\n",
+	"src/os/spin/spin.go":                               "package spin\n\nimport \"runtime/internal/atomic\"\n\nvar _ = atomic.Load\n",
+}
+
+func TestStdZip(t *testing.T) {
+	zipData := buildZip(t, "golang.org/toolchain@v0.0.1-go1.21.0.linux-amd64/", toolchainFiles)
+	out, err := stdZip("std/encoding/json", "v1.21.0", zipData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	var names []string
+	for _, f := range zr.File {
+		if !strings.HasPrefix(f.Name, "std/encoding/json@v1.21.0/") {
+			t.Errorf("unexpected entry %s", f.Name)
+		}
+		rel, _ := zipRelPath(f.Name)
+		src, _ := readZipFile(f)
+		got[rel] = string(src)
+		names = append(names, rel)
+	}
+	sort.Strings(names)
+	want := []string{"LICENSE", "PATENTS", "go.mod", "internal/goclone/internal_/fmtsort/sort.go", "internal/goclone/vendor_/golang.org/x/text/unicode/norm/norm.go", "json.go"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("entries:\n%v\nwant\n%v", names, want)
+	}
+	if want := "module std/encoding/json\n\ngo 1.21\n"; got["go.mod"] != want {
+		t.Errorf("go.mod:\n%s\nwant\n%s", got["go.mod"], want)
+	}
+	for _, imp := range []string{`"bytes"`, `"std/encoding/json/internal/goclone/internal_/fmtsort"`, `"std/encoding/json/internal/goclone/vendor_/golang.org/x/text/unicode/norm"`} {
+		if !strings.Contains(got["json.go"], imp) {
+			t.Errorf("json.go doesn't import %s:\n%s", imp, got["json.go"])
+		}
+	}
+
+	for pkg, code := range map[string]int{
+		"std/crypto/fast":      http.StatusUnprocessableEntity,
+		"std/os/sig":           http.StatusUnprocessableEntity,
+		"std/os/spin":          http.StatusUnprocessableEntity,
+		"std/internal/fmtsort": http.StatusNotFound,
+		"std/encoding/missing": http.StatusNotFound,
+	} {
+		if _, err := stdZip(pkg, "v1.21.0", zipData); errorStatus(err) != code {
+			t.Errorf("%s: got %v, want %d", pkg, err, code)
+		}
+	}
+}
+
+func TestProxyHandlerStd(t *testing.T) {
+	zipData := buildZip(t, "golang.org/toolchain@v0.0.1-go1.21.0.linux-amd64/", toolchainFiles)
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/golang.org/toolchain/@v/list":
+			w.Write([]byte("v0.0.1-go1.21.0.linux-amd64\nv0.0.1-go1.21.0.windows-amd64\nv0.0.1-go1.22.0.linux-amd64\n"))
+		case "/golang.org/toolchain/@v/v0.0.1-go1.21.0.linux-amd64.info":
+			w.Write([]byte(`{"Version":"v0.0.1-go1.21.0.linux-amd64","Time":"2023-08-08T00:00:00Z"}`))
+		case "/golang.org/toolchain/@v/v0.0.1-go1.21.0.linux-amd64.mod":
+			w.Write([]byte("module golang.org/toolchain\n"))
+		case "/golang.org/toolchain/@v/v0.0.1-go1.21.0.linux-amd64.zip":
+			w.Write(zipData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	base := "/_mod/goclone.example.com/_go1.21/std/encoding/json/@v/"
+	for rest, want := range map[string]string{
+		"list":         "v1.21.0\n",
+		"v1.21.0.info": `{"Version":"v1.21.0","Time":"2023-08-08T00:00:00Z"}`,
+		"v1.21.0.mod":  "module goclone.example.com/_go1.21/std/encoding/json\n\ngo 1.21\n",
+	} {
+		w := httptest.NewRecorder()
+		proxyHandler(w, httptest.NewRequest("GET", base+rest, nil))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("%s: %d %q, want %q", rest, w.Code, w.Body, want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", base+"v1.21.0.zip", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("zip: unexpected status %d: %s", w.Code, w.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if rel, _ := zipRelPath(f.Name); rel == "json.go" {
+			src, _ := readZipFile(f)
+			if !bytes.Contains(src, []byte(`"goclone.example.com/_go1.21/std/encoding/json/internal/goclone/internal_/fmtsort"`)) {
+				t.Errorf("import not rewritten:\n%s", src)
+			}
+		}
+	}
+
+	w = httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", base+"v1.22.0.mod", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("version outside the clone: got %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// A subtree clone serves one directory of a module, along with the packages
+// it imports from elsewhere in the module, as a module of its own, named by
+// the module path, "/_/" and the directory, as in
+// "golang.org/x/tools/_/go/packages". The directory becomes the root of the
+// new module. The packages it imports from outside it move under
+// internal/goclone, with their own "internal" elements renamed so that the
+// whole module may import them. The go.mod is the original one, renamed.
+
+// subtreeInternal is the directory that packages from outside the subtree
+// move to.
+const subtreeInternal = "internal/goclone"
+
+// splitSubtree splits the path of a subtree clone into the module path and
+// the directory. Subtrees of major version 2 or later repeat the version
+// suffix at the end, as in "example.com/m/v2/_/pkg/v2", since module paths
+// must end in it.
+func splitSubtree(p string) (mod, dir string, ok bool) {
+	mod, dir, ok = strings.Cut(p, "/_/")
+	if !ok {
+		return "", "", false
+	}
+	if _, major, ok := module.SplitPathVersion(mod); ok && major != "" {
+		if dir, ok = strings.CutSuffix(dir, major); !ok {
+			return "", "", false
+		}
+	}
+	if dir == "" || path.Clean(dir) != dir {
+		return "", "", false
+	}
+	return mod, dir, true
+}
+
+// subtreeSource serves a subtree of a module from the module's upstream.
+type subtreeSource struct {
+	path    string
+	modPath string
+	dir     string
+}
+
+// newSubtreeSource returns the source for the subtree clone p, or nil if p
+// isn't one.
+func newSubtreeSource(p string) *subtreeSource {
+	mod, dir, ok := splitSubtree(p)
+	if !ok {
+		return nil
+	}
+	return &subtreeSource{path: p, modPath: mod, dir: dir}
+}
+
+func (s *subtreeSource) String() string { return "subtree" }
+
+func (s *subtreeSource) fetch(escPath, rest string) (*artifact, error) {
+	ep, err := module.EscapePath(s.modPath)
+	if err != nil {
+		return nil, notFound("%v", err)
+	}
+	ev, isZip := strings.CutSuffix(rest, ".zip")
+	ev, isMod := strings.CutSuffix(ev, ".mod")
+	if !isZip && !isMod {
+		// Versions are those of the whole module.
+		return fetchUpstream(ep, rest)
+	}
+	m, err := fetchUpstream(ep, ev+".mod")
+	if err != nil || m.status != http.StatusOK {
+		return m, err
+	}
+	modData, err := subtreeGoMod(m.body, s.path)
+	if err != nil {
+		return nil, &statusError{http.StatusBadGateway, fmt.Errorf("%s: %v", s.modPath, err)}
+	}
+	if isMod {
+		return &artifact{status: http.StatusOK, header: m.header, body: modData}, nil
+	}
+	z, err := fetchUpstream(ep, rest)
+	if err != nil || z.status != http.StatusOK {
+		return z, err
+	}
+	v, err := module.UnescapeVersion(ev)
+	if err != nil {
+		return nil, notFound("%v", err)
+	}
+	body, err := subtreeZip(s.modPath, s.dir, s.path, v, z.body, modData)
+	if err != nil {
+		return nil, err
+	}
+	return &artifact{status: http.StatusOK, header: z.header, body: body}, nil
+}
+
+// subtreeGoMod returns modData, the go.mod of a module, renamed to newPath.
+func subtreeGoMod(modData []byte, newPath string) ([]byte, error) {
+	f, err := modfile.Parse("go.mod", modData, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.AddModuleStmt(newPath); err != nil {
+		return nil, err
+	}
+	return modfile.Format(f.Syntax), nil
+}
+
+// subtreeZip returns the zip of the module newPath at version v, made from
+// zipData, the zip of modPath, by taking dir and the packages it imports.
+// modData is the new module's go.mod.
+func subtreeZip(modPath, dir, newPath, v string, zipData, modData []byte) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+	if err != nil {
+		return nil, &statusError{http.StatusBadGateway, err}
+	}
+	inTree := func(rel string) bool { return rel == dir || strings.HasPrefix(rel, dir+"/") }
+	files := map[string]*zip.File{}
+	pkgs := map[string][]string{}
+	for _, f := range zr.File {
+		rel, ok := zipRelPath(f.Name)
+		if !ok {
+			continue
+		}
+		files[rel] = f
+		if strings.HasSuffix(rel, ".go") && !strings.HasSuffix(rel, "_test.go") {
+			pkgs[path.Dir(rel)] = append(pkgs[path.Dir(rel)], rel)
+		}
+	}
+
+	// imported is every package in the module that some file imports,
+	// keyed by directory.
+	imported := map[string]bool{}
+	importsOf := func(rel string) ([]string, error) {
+		src, err := readZipFile(files[rel])
+		if err != nil {
+			return nil, err
+		}
+		af, err := parser.ParseFile(token.NewFileSet(), rel, src, parser.ImportsOnly|parser.ParseComments)
+		if err != nil || ignoredFile(af) {
+			return nil, nil
+		}
+		var dirs []string
+		for _, imp := range af.Imports {
+			ip, _ := strconv.Unquote(imp.Path.Value)
+			if ip == modPath {
+				dirs = append(dirs, ".")
+			} else if d, ok := strings.CutPrefix(ip, modPath+"/"); ok {
+				dirs = append(dirs, d)
+			}
+		}
+		for _, d := range dirs {
+			imported[d] = true
+		}
+		return dirs, nil
+	}
+
+	// moved maps the directory of each package taken from outside the
+	// subtree to its new directory.
+	moved := map[string]string{}
+	var queue []string
+	for d := range pkgs {
+		if inTree(d) && linkableDir(d) {
+			queue = append(queue, d)
+		}
+	}
+	if len(queue) == 0 {
+		return nil, notFound("%s@%s: no Go packages in %s", modPath, v, dir)
+	}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		for _, rel := range pkgs[d] {
+			deps, err := importsOf(rel)
+			if err != nil {
+				return nil, err
+			}
+			for _, dep := range deps {
+				if _, ok := moved[dep]; ok || inTree(dep) || pkgs[dep] == nil {
+					continue
+				}
+				moved[dep] = subtreeMovedDir(dep)
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	// embeds holds the //go:embed patterns of each moved package, whose
+	// files in subdirectories must go along with it.
+	embeds := map[string][]string{}
+	for d := range moved {
+		for _, rel := range pkgs[d] {
+			src, err := readZipFile(files[rel])
+			if err != nil {
+				return nil, err
+			}
+			embeds[d] = append(embeds[d], embedPatterns(src)...)
+		}
+	}
+
+	repl := map[string]string{modPath + "/" + dir: newPath}
+	for d, nd := range moved {
+		repl[path.Join(modPath, d)] = newPath + "/" + nd
+	}
+	keep := func(rel string) (string, bool, error) {
+		d := path.Dir(rel)
+		if inTree(d) {
+			if !strings.HasSuffix(rel, "_test.go") {
+				return strings.TrimPrefix(rel, dir+"/"), true, nil
+			}
+			// Tests are kept if they only need packages that were taken.
+			deps, err := importsOf(rel)
+			for _, dep := range deps {
+				if _, ok := moved[dep]; !ok && !inTree(dep) {
+					return "", false, err
+				}
+			}
+			return strings.TrimPrefix(rel, dir+"/"), true, err
+		}
+		if d == "." && isLicenseFile(rel) {
+			return rel, true, nil
+		}
+		// Other files go along with moved packages, in case they are
+		// embedded.
+		if nd, ok := moved[d]; ok && !strings.HasSuffix(rel, "_test.go") && path.Base(rel) != "go.mod" {
+			return nd + "/" + path.Base(rel), true, nil
+		}
+		// Files in subdirectories go along if a moved package above them
+		// embeds them.
+		for a := path.Dir(d); ; a = path.Dir(a) {
+			sub := rel
+			if a != "." {
+				sub = strings.TrimPrefix(rel, a+"/")
+			}
+			if nd, ok := moved[a]; ok && embedded(sub, embeds[a]) {
+				return nd + "/" + sub, true, nil
+			}
+			if a == "." {
+				return "", false, nil
+			}
+		}
+	}
+	out := map[string]*zip.File{}
+	for rel, f := range files {
+		newRel, ok, err := keep(rel)
+		if err != nil {
+			return nil, err
+		}
+		if ok && (out[newRel] == nil || inTree(path.Dir(rel))) {
+			out[newRel] = f
+		}
+	}
+	// Imports of packages that weren't taken, as from nested modules,
+	// map to themselves, so that a moved parent doesn't take them along.
+	for d := range imported {
+		if _, ok := moved[d]; !ok && !inTree(d) {
+			repl[path.Join(modPath, d)] = path.Join(modPath, d)
+		}
+	}
+
+	names := make([]string, 0, len(out))
+	for rel := range out {
+		names = append(names, rel)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	root := newPath + "@" + v + "/"
+	// The go.mod goes first, where extractGoModFromZip finds it.
+	fw, err := zw.Create(root + "go.mod")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fw.Write(modData); err != nil {
+		return nil, err
+	}
+	for _, rel := range names {
+		if rel == "go.mod" {
+			continue
+		}
+		f := out[rel]
+		b, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(rel, ".go") && bytes.Contains(b, []byte(modPath)) {
+			if b, err = rewriteGoFile(f.Name, b, repl, nil); err != nil {
+				return nil, &statusError{http.StatusUnprocessableEntity, fmt.Errorf("%s: %v", f.Name, err)}
+			}
+		}
+		fw, err := zw.Create(root + rel)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := fw.Write(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// subtreeMovedDir returns the new directory for the package in dir, from
+// outside the subtree. "internal" and "vendor" elements get an underscore,
+// so that they lose their meaning to the go command.
+func subtreeMovedDir(dir string) string {
+	if dir == "." {
+		return subtreeInternal
+	}
+	elems := strings.Split(dir, "/")
+	for i, e := range elems {
+		if e == "internal" || e == "vendor" {
+			elems[i] += "_"
+		}
+	}
+	return subtreeInternal + "/" + strings.Join(elems, "/")
+}
+
+// isLicenseFile reports whether the file named name holds license terms.
+func isLicenseFile(name string) bool {
+	base := strings.ToUpper(path.Base(name))
+	for _, prefix := range []string{"LICENSE", "LICENCE", "COPYING", "NOTICE", "PATENTS"} {
+		if strings.HasPrefix(base, prefix) {
+			return true
+		}
+	}
+	return false
+}
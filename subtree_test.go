@@ -0,0 +1,155 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSplitSubtree(t *testing.T) {
+	for _, tt := range []struct{ p, mod, dir string }{
+		{"golang.org/x/tools/_/go/packages", "golang.org/x/tools", "go/packages"},
+		{"example.com/m/v2/_/pkg/v2", "example.com/m/v2", "pkg"},
+		{"example.com/m/v2/_/pkg", "", ""},
+		{"example.com/m/_/", "", ""},
+		{"example.com/m/_/a/../b", "", ""},
+		{"example.com/m", "", ""},
+	} {
+		mod, dir, ok := splitSubtree(tt.p)
+		if mod != tt.mod || dir != tt.dir || ok != (tt.mod != "") {
+			t.Errorf("splitSubtree(%q) = %q, %q, %v, want %q, %q", tt.p, mod, dir, ok, tt.mod, tt.dir)
+		}
+	}
+}
+
+// bigModuleFiles are the files of example.com/big, whose svc/client package
+// imports its own subpackage, an internal package, and through that the
+// module's root package.
+var bigModuleFiles = map[string]string{
+	"go.mod":                         "module example.com/big\n\ngo 1.21\n",
+	"LICENSE":                        "license\n",
+	"README.md":                      "readme\n",
+	"big.go":                         "package big\n\nconst Name = \"big\"\n",
+	"svc/client/client.go":           "package client\n\nimport (\n\t\"example.com/big/internal/util\"\n\t\"example.com/big/svc/client/types\"\n)\n\nfunc Get() types.T { return types.T(util.Name()) }\n",
+	"svc/client/client_test.go":      "package client_test\n\nimport \"example.com/big/svc/client\"\n\nvar _ = client.Get\n",
+	"svc/client/other_test.go":       "package client\n\nimport \"example.com/big/testutil\"\n\nvar _ = testutil.X\n",
+	"svc/client/testdata/x.txt":      "data\n",
+	"svc/client/types/types.go":      "package types\n\ntype T string\n",
+	"internal/util/util.go":          "package util\n\nimport (\n\t\"embed\"\n\n\t\"example.com/big\"\n\t_ \"example.com/big/nested/x\"\n)\n\n//go:embed templates\nvar templates embed.FS\n\nfunc Name() string { return big.Name }\n",
+	"internal/util/util_test.go":     "package util\n",
+	"internal/util/templates/a.tmpl": "template\n",
+	"internal/util/other/b.txt":      "not embedded\n",
+	"svc/other/other.go":             "package other\n",
+	"testutil/testutil.go":           "package testutil\n\nconst X = 1\n",
+}
+
+func TestSubtreeZip(t *testing.T) {
+	zipData := buildZip(t, "example.com/big@v1.0.0/", bigModuleFiles)
+	modData, err := subtreeGoMod([]byte(bigModuleFiles["go.mod"]), "example.com/big/_/svc/client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "module example.com/big/_/svc/client\n\ngo 1.21\n"; string(modData) != want {
+		t.Errorf("go.mod:\n%s\nwant\n%s", modData, want)
+	}
+	out, err := subtreeZip("example.com/big", "svc/client", "example.com/big/_/svc/client", "v1.0.0", zipData, modData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	var names []string
+	for _, f := range zr.File {
+		if !strings.HasPrefix(f.Name, "example.com/big/_/svc/client@v1.0.0/") {
+			t.Errorf("unexpected entry %s", f.Name)
+		}
+		rel, _ := zipRelPath(f.Name)
+		src, _ := readZipFile(f)
+		got[rel] = string(src)
+		names = append(names, rel)
+	}
+	sort.Strings(names)
+	want := []string{"LICENSE", "client.go", "client_test.go", "go.mod", "internal/goclone/README.md", "internal/goclone/big.go", "internal/goclone/internal_/util/templates/a.tmpl", "internal/goclone/internal_/util/util.go", "testdata/x.txt", "types/types.go"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("entries:\n%v\nwant\n%v", names, want)
+	}
+	for rel, imps := range map[string][]string{
+		"client.go":      {`"example.com/big/_/svc/client/internal/goclone/internal_/util"`, `"example.com/big/_/svc/client/types"`},
+		"client_test.go": {`"example.com/big/_/svc/client"`},
+		"internal/goclone/internal_/util/util.go": {`"example.com/big/_/svc/client/internal/goclone"`, `"example.com/big/nested/x"`},
+	} {
+		for _, imp := range imps {
+			if !strings.Contains(got[rel], imp) {
+				t.Errorf("%s doesn't import %s:\n%s", rel, imp, got[rel])
+			}
+		}
+	}
+
+	if _, err := subtreeZip("example.com/big", "nothing", "example.com/big/_/nothing", "v1.0.0", zipData, modData); errorStatus(err) != http.StatusNotFound {
+		t.Errorf("subtree without packages: got %v, want 404", err)
+	}
+}
+
+func TestProxyHandlerSubtree(t *testing.T) {
+	zipData := buildZip(t, "example.com/big@v1.0.0/", bigModuleFiles)
+	serveUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/example.com/big/@v/list":
+			w.Write([]byte("v1.0.0\n"))
+		case "/example.com/big/@v/v1.0.0.mod":
+			w.Write([]byte(bigModuleFiles["go.mod"]))
+		case "/example.com/big/@v/v1.0.0.zip":
+			w.Write(zipData)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	base := "/_mod/goclone.example.com/_two/example.com/big/_/svc/client/@v/"
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", base+"list", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "v1.0.0\n" {
+		t.Errorf("list: %d %q", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", base+"v1.0.0.mod", nil))
+	if want := "module goclone.example.com/_two/example.com/big/_/svc/client\n\ngo 1.21\n"; w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("mod: %d\n%s\nwant\n%s", w.Code, w.Body, want)
+	}
+
+	w = httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", base+"v1.0.0.zip", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("zip: unexpected status %d: %s", w.Code, w.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if !strings.HasPrefix(f.Name, "goclone.example.com/_two/example.com/big/_/svc/client@v1.0.0/") {
+			t.Errorf("unexpected entry %s", f.Name)
+		}
+		if path.Base(f.Name) == "client.go" {
+			src, _ := readZipFile(f)
+			if !bytes.Contains(src, []byte(`"goclone.example.com/_two/example.com/big/_/svc/client/types"`)) {
+				t.Errorf("import not rewritten:\n%s", src)
+			}
+		}
+	}
+
+	w = httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_two/example.com/big/_/nothing/@v/v1.0.0.zip", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("subtree without packages: got %d, want 404", w.Code)
+	}
+}
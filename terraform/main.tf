@@ -38,8 +38,17 @@ resource "aws_lambda_function" "goclone" {
   runtime          = "provided.al2"
   filename         = var.lambda_package
   source_code_hash = filebase64sha256(var.lambda_package)
-  memory_size      = 512
+  memory_size      = var.memory_size
   timeout          = 30
+
+  environment {
+    variables = {
+      GOCLONE_REWRITE_WORKERS = var.rewrite_workers
+      GOCLONE_UPSTREAM        = var.upstream
+      GOCLONE_CONFIG          = var.config_file
+      GOCLONE_POLICY          = var.policy_file
+    }
+  }
 }
 
 resource "aws_lambda_function_url" "goclone" {
@@ -64,3 +73,33 @@ variable "lambda_package" {
   description = "Path to the zipped lambda package"
   type        = string
 }
+
+variable "memory_size" {
+  description = "Lambda memory in MB; this also determines the number of vCPUs"
+  type        = number
+  default     = 512
+}
+
+variable "rewrite_workers" {
+  description = "Number of module zip entries rewritten concurrently"
+  type        = number
+  default     = 2
+}
+
+variable "upstream" {
+  description = "Upstream module proxies, in GOPROXY list syntax"
+  type        = string
+  default     = "https://proxy.golang.org"
+}
+
+variable "config_file" {
+  description = "Path of the goclone configuration file inside the Lambda package, if any"
+  type        = string
+  default     = ""
+}
+
+variable "policy_file" {
+  description = "Path of the goclone policy file inside the Lambda package, if any"
+  type        = string
+  default     = ""
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// An upstreamFetcher serves the files of the module proxy protocol.
+type upstreamFetcher interface {
+	// fetch returns rest, a file under @v/ such as "list" or
+	// "v1.0.0.zip", or "@latest", for the module p.
+	fetch(p, rest string) (*artifact, error)
+}
+
+// An upstreamSource is an upstreamFetcher that can be named in an upstream
+// chain, in whose responses it is identified.
+type upstreamSource interface {
+	upstreamFetcher
+	// String describes the source without revealing any credentials.
+	String() string
+}
+
+// upstreamChain tries a list of sources in order, following the fallback
+// rules of the GOPROXY environment variable.
+type upstreamChain struct {
+	sources []upstreamSource
+	// anyErr[i] is true if sources[i] was followed by "|", meaning the next
+	// source is tried after any error and not only after 404 or 410.
+	anyErr []bool
+}
+
+// parseUpstream parses a GOPROXY-style list of upstreams such as
+// "https://athens.internal,https://proxy.golang.org" or "off".
+func parseUpstream(spec string) (*upstreamChain, error) {
+	return parseUpstreamAuth(spec, nil)
+}
+
+// parseUpstreamAuth is like parseUpstream, but the HTTP proxies in the list
+// authenticate with auth.
+func parseUpstreamAuth(spec string, auth *credentials) (*upstreamChain, error) {
+	c := &upstreamChain{}
+	for spec != "" {
+		elem := spec
+		anyErr := false
+		if i := strings.IndexAny(spec, ",|"); i >= 0 {
+			elem, anyErr, spec = spec[:i], spec[i] == '|', spec[i+1:]
+		} else {
+			spec = ""
+		}
+		elem = strings.TrimSpace(elem)
+		if elem == "" {
+			continue
+		}
+		src, err := parseUpstreamSource(elem, auth)
+		if err != nil {
+			return nil, err
+		}
+		c.sources = append(c.sources, src)
+		c.anyErr = append(c.anyErr, anyErr)
+	}
+	if len(c.sources) == 0 {
+		return nil, errors.New("upstream list is empty")
+	}
+	return c, nil
+}
+
+func parseUpstreamSource(elem string, auth *credentials) (upstreamSource, error) {
+	switch elem {
+	case "off":
+		return offSource{}, nil
+	case "direct":
+		return directSource{}, nil
+	}
+	u, err := url.Parse(elem)
+	if err != nil {
+		// The error would repeat elem, which may hold a password.
+		return nil, errors.New("invalid upstream URL")
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &proxySource{url: u, auth: auth}, nil
+	case "file":
+		return newFileSource(u)
+	}
+	return nil, fmt.Errorf("unsupported upstream %q", u.Redacted())
+}
+
+func (c *upstreamChain) fetch(p, rest string) (*artifact, error) {
+	var a *artifact
+	var err error
+	for i, src := range c.sources {
+		a, err = src.fetch(p, rest)
+		if a != nil {
+			a.header.Set("X-Goclone-Upstream", src.String())
+		}
+		if err == nil && a.status == http.StatusOK {
+			return a, nil
+		}
+		notFound := err == nil && (a.status == http.StatusNotFound || a.status == http.StatusGone)
+		if !notFound && !c.anyErr[i] {
+			break
+		}
+	}
+	return a, err
+}
+
+// proxySource is a module proxy spoken to over HTTP.
+type proxySource struct {
+	url  *url.URL
+	auth *credentials
+}
+
+func (s *proxySource) String() string { return s.url.Redacted() }
+
+func (s *proxySource) fetch(p, rest string) (*artifact, error) {
+	upstreamURL := fmt.Sprintf("%s/%s/@v/%s", strings.TrimSuffix(s.url.String(), "/"), p, rest)
+	if rest == "@latest" {
+		upstreamURL = fmt.Sprintf("%s/%s/@latest", strings.TrimSuffix(s.url.String(), "/"), p)
+	}
+	req, err := http.NewRequest("GET", upstreamURL, nil)
+	if err != nil {
+		return nil, errors.New("invalid upstream URL")
+	}
+	if err := s.auth.apply(req); err != nil {
+		return nil, &statusError{http.StatusBadGateway, fmt.Errorf("%s: %v", s, err)}
+	}
+	// The client redacts passwords in URLs from its errors.
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, &statusError{http.StatusBadGateway, err}
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &statusError{http.StatusBadGateway, err}
+	}
+	header := resp.Header.Clone()
+	// Go's HTTP client automatically decompresses gzip responses. If the
+	// upstream sent a gzip encoded body, resp.Body will already be
+	// decompressed but the Content-Encoding header will still be present.
+	// Strip it to avoid telling the client the body is gzip when it isn't.
+	header.Del("Content-Encoding")
+	return &artifact{status: resp.StatusCode, header: header, body: data}, nil
+}
+
+// offSource refuses every lookup, like GOPROXY=off.
+type offSource struct{}
+
+func (offSource) String() string { return "off" }
+
+func (offSource) fetch(p, rest string) (*artifact, error) {
+	return nil, &statusError{http.StatusForbidden, fmt.Errorf("%s: module lookup disabled by upstream \"off\"", p)}
+}
+
+// upstreamFor returns the source for module p: a Go release for a standard
+// library clone, a subtree of another module, the local working directory
+// configured for it, the upstream of the first matching rule in the
+// configuration, or else the -upstream chain.
+func upstreamFor(p string) (upstreamFetcher, error) {
+	if mp, err := unescapeModPath(p); err == nil {
+		if strings.HasPrefix(mp, stdPrefix) {
+			return &stdSource{path: mp}, nil
+		}
+		if s := newSubtreeSource(mp); s != nil {
+			return s, nil
+		}
+		if spec, ok := localModules[mp]; ok {
+			return newLocalSource(mp, spec)
+		}
+		if r := conf.upstreamRule(mp); r != nil {
+			return parseUpstreamAuth(r.Upstream, r.Auth)
+		}
+	}
+	return parseUpstream(*upstream)
+}
+
+// fetchUpstream fetches rest (e.g. "list" or "v1.0.0.zip") for module p from
+// its upstream. Concurrent fetches of the same file share one request.
+func fetchUpstream(p, rest string) (*artifact, error) {
+	return upstreamFlights.do(p+"/@v/"+rest, func() (*artifact, error) {
+		src, err := upstreamFor(p)
+		if err != nil {
+			return nil, err
+		}
+		a, err := src.fetch(p, rest)
+		if err != nil {
+			return nil, err
+		}
+		// Local sources change as they are edited, so only cache go.mod
+		// files from real upstreams.
+		if _, local := src.(*localSource); !local && a.status == http.StatusOK && strings.HasSuffix(rest, ".mod") {
+			upstreamMods.put(p+"@"+strings.TrimSuffix(rest, ".mod"), a.body)
+		}
+		return a, nil
+	})
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	modzip "golang.org/x/mod/zip"
+)
+
+// directSource builds module proxy files straight from git repositories,
+// like GOPROXY=direct does in the go command. Repositories are found through
+// -direct-repo or, failing that, the go-import meta tag of the module path.
+type directSource struct{}
+
+func (directSource) String() string { return "direct" }
+
+// repoSyncInterval is how long a fetched repository is considered fresh.
+const repoSyncInterval = time.Minute
+
+var (
+	repoSyncs  flightGroup[struct{}]
+	repoSynced sync.Map // repository dir -> time.Time of last fetch
+)
+
+// gitRepo is a local copy of a remote git repository.
+type gitRepo struct {
+	url string
+	dir string
+	// protocol is the only transport git may use for the repository.
+	protocol string
+}
+
+// vcsModule is a module stored in a git repository.
+type vcsModule struct {
+	repo *gitRepo
+	path string
+	// dir is the module's directory within the repository, not counting a
+	// major version suffix, and tagPrefix is the prefix of its version tags.
+	dir       string
+	tagPrefix string
+	pathMajor string
+}
+
+func notFound(format string, args ...any) error {
+	return &statusError{http.StatusNotFound, fmt.Errorf(format, args...)}
+}
+
+func (directSource) fetch(escPath, rest string) (*artifact, error) {
+	p, err := module.UnescapePath(escPath)
+	if err != nil {
+		return nil, notFound("%v", err)
+	}
+	m, err := lookupVCSModule(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.repo.sync(); err != nil {
+		return nil, &statusError{http.StatusBadGateway, err}
+	}
+	var body []byte
+	switch {
+	case rest == "list":
+		vers, err := m.versions()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range vers {
+			body = append(body, v+"\n"...)
+		}
+	case rest == "@latest":
+		body, err = m.latest()
+	case strings.HasSuffix(rest, ".info"), strings.HasSuffix(rest, ".mod"), strings.HasSuffix(rest, ".zip"):
+		ext := path.Ext(rest)
+		v, err := module.UnescapeVersion(strings.TrimSuffix(rest, ext))
+		if err != nil {
+			return nil, notFound("%v", err)
+		}
+		switch ext {
+		case ".info":
+			body, err = m.info(v)
+		case ".mod":
+			body, err = m.goMod(v)
+		default:
+			body, err = m.zip(v)
+		}
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, notFound("unknown file %q", rest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &artifact{status: http.StatusOK, header: http.Header{}, body: body}, nil
+}
+
+// lookupVCSModule finds the repository holding module p.
+func lookupVCSModule(p string) (*vcsModule, error) {
+	root, url, ok := directRepos.lookup(p)
+	if !ok {
+		var err error
+		root, url, err = discoverRepo(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+	protocol := repoProtocol(url)
+	sum := sha256.Sum256([]byte(url))
+	m := &vcsModule{
+		repo: &gitRepo{url: url, dir: filepath.Join(*vcsCache, hex.EncodeToString(sum[:8])), protocol: protocol},
+		path: p,
+	}
+	prefix, pathMajor, _ := module.SplitPathVersion(p)
+	m.pathMajor = pathMajor
+	if !strings.HasPrefix(pathMajor, "/") {
+		// gopkg.in style major versions aren't directories.
+		prefix = p
+	}
+	if prefix != root {
+		m.dir = strings.TrimPrefix(prefix, root+"/")
+		m.tagPrefix = m.dir + "/"
+	}
+	return m, nil
+}
+
+var goImportRE = regexp.MustCompile(`<meta\s+name="go-import"\s+content="([^"]*)"`)
+
+// discoverRepo finds the git repository for p from the go-import meta tag
+// served at https://p?go-get=1. Only https repositories are accepted, and
+// ssh ones with -direct-ssh.
+func discoverRepo(p string) (root, url string, err error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get("https://" + p + "?go-get=1")
+	if err != nil {
+		return "", "", &statusError{http.StatusBadGateway, err}
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", "", &statusError{http.StatusBadGateway, err}
+	}
+	for _, m := range goImportRE.FindAllSubmatch(body, -1) {
+		f := strings.Fields(string(m[1]))
+		if len(f) != 3 || (p != f[0] && !strings.HasPrefix(p, f[0]+"/")) {
+			continue
+		}
+		if f[1] != "git" {
+			return "", "", notFound("%s: unsupported version control system %q", p, f[1])
+		}
+		// Anyone can serve a go-import tag, so the repository mustn't be
+		// local files or a command, as with file:// and ext::.
+		if proto := repoProtocol(f[2]); proto != "https" && (proto != "ssh" || !*directSSH) {
+			return "", "", notFound("%s: repository %s: unsupported protocol %q", p, f[2], proto)
+		}
+		return f[0], f[2], nil
+	}
+	return "", "", notFound("%s: no git repository found", p)
+}
+
+// repoProtocol returns the git transport for the repository URL, like
+// "https", "ssh" for scp-like "user@host:path" and "file" for local paths.
+func repoProtocol(url string) string {
+	if scheme, _, ok := strings.Cut(url, "://"); ok {
+		return scheme
+	}
+	if scheme, _, ok := strings.Cut(url, "::"); ok {
+		// Remote helpers, like "ext::cmd".
+		return scheme
+	}
+	if i := strings.Index(url, ":"); i > 0 && !strings.Contains(url[:i], "/") {
+		return "ssh"
+	}
+	return "file"
+}
+
+func (r *gitRepo) git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "PWD="+r.dir, "GIT_ALLOW_PROTOCOL="+r.protocol)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// sync fetches the branches and tags of r unless that was done recently.
+func (r *gitRepo) sync() error {
+	if t, ok := repoSynced.Load(r.dir); ok && time.Since(t.(time.Time)) < repoSyncInterval {
+		return nil
+	}
+	_, err := repoSyncs.do(r.dir, func() (struct{}, error) {
+		if _, err := os.Stat(filepath.Join(r.dir, ".git")); err != nil {
+			if err := os.MkdirAll(r.dir, 0o755); err != nil {
+				return struct{}{}, err
+			}
+			if _, err := r.git("init", "-q"); err != nil {
+				return struct{}{}, err
+			}
+		}
+		_, err := r.git("fetch", "-q", "-f", "--prune", r.url,
+			"+refs/heads/*:refs/remotes/origin/*",
+			"+refs/tags/*:refs/tags/*",
+			"+HEAD:refs/remotes/origin/HEAD")
+		if err == nil {
+			repoSynced.Store(r.dir, time.Now())
+		}
+		return struct{}{}, err
+	})
+	return err
+}
+
+// resolve returns the full commit hash for a tag, branch or commit hash.
+func (r *gitRepo) resolve(rev string) (string, error) {
+	if strings.HasPrefix(rev, "-") {
+		return "", notFound("invalid revision %q", rev)
+	}
+	for _, ref := range []string{"refs/tags/" + rev, "refs/remotes/origin/" + rev, rev} {
+		if out, err := r.git("rev-parse", "--verify", "-q", ref+"^{commit}"); err == nil {
+			return strings.TrimSpace(string(out)), nil
+		}
+	}
+	if isHex(rev) {
+		// The commit may not be on any branch. Many servers will still
+		// hand it out when asked for it by hash.
+		if _, err := r.git("fetch", "-q", r.url, rev); err == nil {
+			if out, err := r.git("rev-parse", "--verify", "-q", "FETCH_HEAD^{commit}"); err == nil {
+				if hash := strings.TrimSpace(string(out)); strings.HasPrefix(hash, rev) {
+					return hash, nil
+				}
+			}
+		}
+	}
+	return "", notFound("unknown revision %s", rev)
+}
+
+func isHex(s string) bool {
+	if len(s) < 7 {
+		return false
+	}
+	_, err := hex.DecodeString(s[:len(s)&^1])
+	return err == nil
+}
+
+func (r *gitRepo) commitTime(hash string) (time.Time, error) {
+	out, err := r.git("log", "-1", "--format=%ct", hash)
+	if err != nil {
+		return time.Time{}, err
+	}
+	sec, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(sec, 0).UTC(), nil
+}
+
+// tagVersions returns the valid versions of m among the tags listed by git
+// tag with the given extra arguments.
+func (m *vcsModule) tagVersions(args ...string) ([]string, error) {
+	out, err := m.repo.git(append([]string{"tag", "-l"}, append(args, m.tagPrefix+"v*")...)...)
+	if err != nil {
+		return nil, err
+	}
+	var vers []string
+	for _, tag := range strings.Fields(string(out)) {
+		v := strings.TrimPrefix(tag, m.tagPrefix)
+		if semver.Canonical(v) != v || module.IsPseudoVersion(v) || module.Check(m.path, v) != nil {
+			continue
+		}
+		vers = append(vers, v)
+	}
+	semver.Sort(vers)
+	return vers, nil
+}
+
+func (m *vcsModule) versions() ([]string, error) {
+	return m.tagVersions()
+}
+
+func (m *vcsModule) latest() ([]byte, error) {
+	vers, err := m.versions()
+	if err != nil {
+		return nil, err
+	}
+	// Like the go command, prefer the highest release to prereleases,
+	// and tagged versions to the latest commit.
+	for i := len(vers) - 1; i >= 0; i-- {
+		if semver.Prerelease(vers[i]) == "" {
+			return m.info(vers[i])
+		}
+	}
+	if len(vers) > 0 {
+		return m.info(vers[len(vers)-1])
+	}
+	return m.info("HEAD")
+}
+
+// info resolves query, which may be a version, branch, tag or commit hash,
+// and returns its .info file.
+func (m *vcsModule) info(query string) ([]byte, error) {
+	hash, err := m.revision(query)
+	if err != nil {
+		return nil, err
+	}
+	t, err := m.repo.commitTime(hash)
+	if err != nil {
+		return nil, err
+	}
+	v := query
+	if semver.Canonical(v) != v || module.Check(m.path, v) != nil {
+		v, err = m.pseudoVersion(hash, t)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(struct {
+		Version string
+		Time    time.Time
+	}{v, t})
+}
+
+// revision returns the commit hash for a version or other query.
+func (m *vcsModule) revision(query string) (string, error) {
+	if module.IsPseudoVersion(query) {
+		rev, err := module.PseudoVersionRev(query)
+		if err != nil {
+			return "", notFound("%v", err)
+		}
+		return m.repo.resolve(rev)
+	}
+	if semver.IsValid(query) {
+		return m.repo.resolve(m.tagPrefix + query)
+	}
+	if query == "HEAD" {
+		return m.repo.resolve("HEAD")
+	}
+	return m.repo.resolve(query)
+}
+
+// pseudoVersion returns the version for commit hash: the highest version
+// tagged on it or, if there is none, a pseudo-version based on the highest
+// version tagged on one of its ancestors.
+func (m *vcsModule) pseudoVersion(hash string, t time.Time) (string, error) {
+	tagged, err := m.tagVersions("--points-at", hash)
+	if err != nil {
+		return "", err
+	}
+	if len(tagged) > 0 {
+		return tagged[len(tagged)-1], nil
+	}
+	older, err := m.tagVersions("--merged", hash)
+	if err != nil {
+		return "", err
+	}
+	base := ""
+	if len(older) > 0 {
+		base = older[len(older)-1]
+	}
+	major := strings.TrimLeft(m.pathMajor, "/.")
+	return module.PseudoVersion(major, base, t, hash[:12]), nil
+}
+
+// subdir returns the directory of m at commit hash. A module with a major
+// version suffix may live either in a directory named after the suffix or
+// in the directory without it.
+func (m *vcsModule) subdir(hash string) string {
+	if strings.HasPrefix(m.pathMajor, "/") {
+		dir := path.Join(m.dir, m.pathMajor[1:])
+		if _, err := m.repo.git("cat-file", "-e", hash+":"+dir+"/go.mod"); err == nil {
+			return dir
+		}
+	}
+	return m.dir
+}
+
+// checkVersion makes sure v is a canonical version of m and returns its
+// commit hash.
+func (m *vcsModule) checkVersion(v string) (string, error) {
+	if err := module.Check(m.path, v); err != nil || semver.Canonical(v) != v {
+		return "", notFound("%s: invalid version %q", m.path, v)
+	}
+	return m.revision(v)
+}
+
+func (m *vcsModule) goMod(v string) ([]byte, error) {
+	hash, err := m.checkVersion(v)
+	if err != nil {
+		return nil, err
+	}
+	file := path.Join(m.subdir(hash), "go.mod")
+	data, err := m.repo.git("cat-file", "blob", hash+":"+file)
+	if err != nil {
+		// Like the go command, synthesize a go.mod for modules without one.
+		return []byte(fmt.Sprintf("module %s\n", m.path)), nil
+	}
+	return data, nil
+}
+
+func (m *vcsModule) zip(v string) ([]byte, error) {
+	hash, err := m.checkVersion(v)
+	if err != nil {
+		return nil, err
+	}
+	dir := m.subdir(hash)
+	if dir != "" {
+		dir += "/"
+	}
+	var buf bytes.Buffer
+	err = modzip.CreateFromVCS(&buf, module.Version{Path: m.path, Version: v}, m.repo.dir, hash, dir)
+	if err != nil {
+		var fe modzip.FileErrorList
+		if errors.As(err, &fe) {
+			return nil, &statusError{http.StatusUnprocessableEntity, err}
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newGitRepo creates a repository with a tagged v1.0.0 commit followed by an
+// untagged commit on the main branch.
+func newGitRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	git := func(date string, args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_COMMITTER_DATE="+date, "GIT_AUTHOR_DATE="+date)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	write := func(name, data string) {
+		t.Helper()
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0o755)
+		if err := os.WriteFile(p, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("", "init", "-q", "-b", "main")
+	write("go.mod", "module example.com/repo\n\ngo 1.20\n")
+	write("pkg/pkg.go", "package pkg\n\nconst Version = \"v1.0.0\"\n")
+	write("use/use.go", "package use\n\nimport _ \"example.com/repo/pkg\"\n")
+	git("2023-01-01T00:00:00Z", "add", ".")
+	git("2023-01-01T00:00:00Z", "commit", "-q", "-m", "first")
+	git("", "tag", "v1.0.0")
+	write("pkg/pkg.go", "package pkg\n\nconst Version = \"next\"\n")
+	git("2023-02-01T00:00:00Z", "commit", "-q", "-a", "-m", "second")
+	return dir
+}
+
+func TestDirectSource(t *testing.T) {
+	repo := newGitRepo(t)
+	*vcsCache = t.TempDir()
+	directRepos["example.com/repo"] = "file://" + repo
+	defer delete(directRepos, "example.com/repo")
+
+	fetch := func(rest string) string {
+		t.Helper()
+		a, err := directSource{}.fetch("example.com/repo", rest)
+		if err != nil {
+			t.Fatalf("%s: %v", rest, err)
+		}
+		return string(a.body)
+	}
+	if got := fetch("list"); got != "v1.0.0\n" {
+		t.Errorf("unexpected list: %q", got)
+	}
+	var info struct{ Version string }
+	json.Unmarshal([]byte(fetch("main.info")), &info)
+	if !strings.HasPrefix(info.Version, "v1.0.1-0.20230201000000-") {
+		t.Errorf("unexpected pseudo-version for main: %s", info.Version)
+	}
+	json.Unmarshal([]byte(fetch("@latest")), &info)
+	if info.Version != "v1.0.0" {
+		t.Errorf("unexpected latest: %s", info.Version)
+	}
+	if got := fetch("v1.0.0.mod"); !strings.HasPrefix(got, "module example.com/repo\n") {
+		t.Errorf("unexpected go.mod: %q", got)
+	}
+
+	pseudo := fetch("main.info")
+	json.Unmarshal([]byte(pseudo), &info)
+	data := fetch(info.Version + ".zip")
+	r, err := zip.NewReader(bytes.NewReader([]byte(data)), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, f := range r.File {
+		if !strings.HasPrefix(f.Name, "example.com/repo@"+info.Version+"/") {
+			t.Errorf("unexpected file %s", f.Name)
+		}
+		if strings.HasSuffix(f.Name, "pkg/pkg.go") {
+			b, _ := readZipFile(f)
+			found = bytes.Contains(b, []byte("next"))
+		}
+	}
+	if !found {
+		t.Error("zip does not hold the second commit")
+	}
+
+	if _, err := (directSource{}).fetch("example.com/repo", "v9.0.0.zip"); errorStatus(err) != http.StatusNotFound {
+		t.Errorf("expected not found for unknown version, got %v", err)
+	}
+}
+
+func TestProxyHandlerDirect(t *testing.T) {
+	repo := newGitRepo(t)
+	*vcsCache = t.TempDir()
+	directRepos["example.com/repo"] = "file://" + repo
+	defer delete(directRepos, "example.com/repo")
+	useUpstream(t, "direct")
+
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest("GET", "/_mod/goclone.example.com/_fork/example.com/repo/@v/v1.0.0.zip", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("X-Goclone-Upstream"); got != "direct" {
+		t.Errorf("unexpected upstream %q", got)
+	}
+	data := w.Body.Bytes()
+	r, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range r.File {
+		if !strings.HasPrefix(f.Name, "goclone.example.com/_fork/example.com/repo@v1.0.0/") {
+			t.Errorf("file name not rewritten: %s", f.Name)
+		}
+		if strings.HasSuffix(f.Name, "use/use.go") {
+			b, _ := readZipFile(f)
+			if !bytes.Contains(b, []byte("goclone.example.com/_fork/example.com/repo/pkg")) {
+				t.Errorf("import not rewritten: %s", b)
+			}
+		}
+	}
+}
+
+func TestRepoProtocol(t *testing.T) {
+	for url, want := range map[string]string{
+		"https://github.com/a/b":     "https",
+		"ssh://git@github.com/a/b":   "ssh",
+		"git@github.com:a/b.git":     "ssh",
+		"file:///srv/git/b":          "file",
+		"/srv/git/b":                 "file",
+		"./b":                        "file",
+		"ext::sh -c touch% /tmp/pwn": "ext",
+	} {
+		if got := repoProtocol(url); got != want {
+			t.Errorf("repoProtocol(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
+
+func TestGitRepoAllowedProtocol(t *testing.T) {
+	repo := newGitRepo(t)
+	r := &gitRepo{url: "file://" + repo, dir: t.TempDir(), protocol: "https"}
+	if err := r.sync(); err == nil {
+		t.Error("fetched a file:// repository with only https allowed")
+	}
+}
+
+func TestDirectSourceLatestPrefersRelease(t *testing.T) {
+	repo := newGitRepo(t)
+	if out, err := exec.Command("git", "-C", repo, "tag", "v1.1.0-rc.1").CombinedOutput(); err != nil {
+		t.Fatalf("git tag: %v\n%s", err, out)
+	}
+	*vcsCache = t.TempDir()
+	directRepos["example.com/repo"] = "file://" + repo
+	defer delete(directRepos, "example.com/repo")
+
+	a, err := directSource{}.fetch("example.com/repo", "@latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct{ Version string }
+	json.Unmarshal(a.body, &info)
+	if info.Version != "v1.0.0" {
+		t.Errorf("latest = %s, want v1.0.0 over the prerelease", info.Version)
+	}
+}
+
+func TestDirectSourceEscapedVersion(t *testing.T) {
+	repo := newGitRepo(t)
+	if out, err := exec.Command("git", "-C", repo, "tag", "v1.1.0-RC1").CombinedOutput(); err != nil {
+		t.Fatalf("git tag: %v\n%s", err, out)
+	}
+	*vcsCache = t.TempDir()
+	directRepos["example.com/repo"] = "file://" + repo
+	defer delete(directRepos, "example.com/repo")
+
+	for _, rest := range []string{"v1.1.0-!r!c1.info", "v1.1.0-!r!c1.mod", "v1.1.0-!r!c1.zip"} {
+		if _, err := (directSource{}).fetch("example.com/repo", rest); err != nil {
+			t.Errorf("%s: %v", rest, err)
+		}
+	}
+}
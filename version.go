@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+)
+
+// versionConstraint is a set of semver ranges like ">=v1.2.0, <v2.0.0 ||
+// v2.3.1". Comparisons separated by commas must all hold; alternatives
+// separated by "||" need only one to hold. A bare version means "=".
+type versionConstraint struct {
+	text string
+	alts [][]versionComparison
+}
+
+type versionComparison struct {
+	op      string
+	version string
+}
+
+func parseVersionConstraint(s string) (*versionConstraint, error) {
+	c := &versionConstraint{text: s}
+	for _, alt := range strings.Split(s, "||") {
+		var cmps []versionComparison
+		for _, term := range strings.Split(alt, ",") {
+			term = strings.TrimSpace(term)
+			op := "="
+			for _, o := range []string{">=", "<=", "!=", ">", "<", "="} {
+				if strings.HasPrefix(term, o) {
+					op = o
+					break
+				}
+			}
+			v := strings.TrimSpace(strings.TrimPrefix(term, op))
+			if !semver.IsValid(v) {
+				return nil, fmt.Errorf("invalid version %q in constraint %q", v, s)
+			}
+			cmps = append(cmps, versionComparison{op, v})
+		}
+		c.alts = append(c.alts, cmps)
+	}
+	return c, nil
+}
+
+func (c *versionConstraint) String() string { return c.text }
+
+func (c *versionConstraint) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	p, err := parseVersionConstraint(s)
+	if err != nil {
+		return err
+	}
+	*c = *p
+	return nil
+}
+
+// allows reports whether v satisfies c. A nil constraint allows everything.
+func (c *versionConstraint) allows(v string) bool {
+	if c == nil {
+		return true
+	}
+	for _, alt := range c.alts {
+		if altAllows(alt, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// altAllows reports whether v satisfies every comparison of alt.
+func altAllows(alt []versionComparison, v string) bool {
+	for _, cmp := range alt {
+		if !cmp.allows(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// satisfiable reports whether some version satisfies c: whether the bounds
+// of any of its alternatives leave a version between them.
+func (c *versionConstraint) satisfiable() bool {
+	if c == nil {
+		return true
+	}
+	for _, alt := range c.alts {
+		var lo, hi string
+		loIncl, hiIncl := true, true
+		for _, cmp := range alt {
+			if cmp.op == "=" || cmp.op == ">=" || cmp.op == ">" {
+				if n := semver.Compare(cmp.version, lo); lo == "" || n > 0 || n == 0 && cmp.op == ">" {
+					lo, loIncl = cmp.version, cmp.op != ">"
+				}
+			}
+			if cmp.op == "=" || cmp.op == "<=" || cmp.op == "<" {
+				if n := semver.Compare(cmp.version, hi); hi == "" || n < 0 || n == 0 && cmp.op == "<" {
+					hi, hiIncl = cmp.version, cmp.op != "<"
+				}
+			}
+		}
+		if lo == "" || hi == "" {
+			return true
+		}
+		switch n := semver.Compare(lo, hi); {
+		case n < 0:
+			return true
+		case n == 0 && loIncl && hiIncl:
+			// A single version, unless another comparison excludes it.
+			if altAllows(alt, lo) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (cmp versionComparison) allows(v string) bool {
+	n := semver.Compare(v, cmp.version)
+	switch cmp.op {
+	case "=":
+		return n == 0
+	case "!=":
+		return n != 0
+	case "<":
+		return n < 0
+	case "<=":
+		return n <= 0
+	case ">":
+		return n > 0
+	case ">=":
+		return n >= 0
+	}
+	return false
+}
+
+// restVersion returns the version named by a .info, .mod or .zip file, or
+// false for other files.
+func restVersion(rest string) (string, bool) {
+	for _, ext := range []string{".info", ".mod", ".zip"} {
+		if v, ok := strings.CutSuffix(rest, ext); ok {
+			v, err := module.UnescapeVersion(v)
+			return v, err == nil
+		}
+	}
+	return "", false
+}
+
+// infoVersion returns the version in a .info or @latest response.
+func infoVersion(body []byte) (string, error) {
+	var info struct{ Version string }
+	if err := json.Unmarshal(body, &info); err != nil {
+		return "", &statusError{http.StatusBadGateway, fmt.Errorf("bad version info: %v", err)}
+	}
+	return info.Version, nil
+}
+
+// filterList returns a copy of the @v/list artifact a without the versions
+// for which check fails.
+func filterList(a *artifact, check func(v string) error) *artifact {
+	var body []byte
+	for _, v := range strings.Fields(string(a.body)) {
+		if check(v) == nil {
+			body = append(body, v+"\n"...)
+		}
+	}
+	return &artifact{status: a.status, header: a.header, body: body}
+}
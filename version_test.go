@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestVersionConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		allowed    []string
+		denied     []string
+	}{
+		{">=v1.2.0, <v2.0.0", []string{"v1.2.0", "v1.9.9", "v1.3.0-pre"}, []string{"v1.1.9", "v2.0.0", "v1.2.0-rc.1"}},
+		{"v1.0.0 || >v3", []string{"v1.0.0", "v3.0.1"}, []string{"v1.0.1", "v3.0.0"}},
+		{"!=v1.5.0", []string{"v1.4.0"}, []string{"v1.5.0"}},
+		{"<=v0.3.0", []string{"v0.3.0", "v0.0.0-20200101000000-abcdefabcdef"}, []string{"v0.3.1"}},
+	}
+	for _, tt := range tests {
+		c, err := parseVersionConstraint(tt.constraint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range tt.allowed {
+			if !c.allows(v) {
+				t.Errorf("%s should allow %s", tt.constraint, v)
+			}
+		}
+		for _, v := range tt.denied {
+			if c.allows(v) {
+				t.Errorf("%s should not allow %s", tt.constraint, v)
+			}
+		}
+	}
+	for _, bad := range []string{"", ">=1.2.0", "v1.0.0,", "~v1.2"} {
+		if _, err := parseVersionConstraint(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestVersionConstraintSatisfiable(t *testing.T) {
+	for c, want := range map[string]bool{
+		">=v1.2.0, <v2.0.0":  true,
+		"<v1.0.0":            true,
+		"v1.0.0":             true,
+		">=v1.0.0, <=v1.0.0": true,
+		">v2.0.0, <v1.0.0":   false,
+		">=v1.0.0, <v1.0.0":  false,
+		"v1.0.0, !=v1.0.0":   false,
+		"v1.0.0, v1.1.0":     false,
+		">v2.0.0, <v1 || v3": true,
+	} {
+		vc, err := parseVersionConstraint(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := vc.satisfiable(); got != want {
+			t.Errorf("%s: satisfiable = %v, want %v", c, got, want)
+		}
+	}
+}